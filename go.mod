@@ -3,9 +3,12 @@ module github.com/niconiconainu/mautrix-zalo
 go 1.24.0
 
 require (
+	github.com/buckket/go-blurhash v1.1.0
 	github.com/gorilla/websocket v1.5.3
+	github.com/mattn/go-sqlite3 v1.14.34
 	github.com/rs/zerolog v1.34.0
 	go.mau.fi/util v0.9.5
+	golang.org/x/image v0.25.0
 	maunium.net/go/mautrix v0.26.2
 )
 
@@ -16,7 +19,6 @@ require (
 	github.com/lib/pq v1.10.9 // indirect
 	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	github.com/mattn/go-sqlite3 v1.14.34 // indirect
 	github.com/petermattis/goid v0.0.0-20260113132338-7c7de50cc741 // indirect
 	github.com/rs/xid v1.6.0 // indirect
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e // indirect
@@ -0,0 +1,66 @@
+package connector
+
+import (
+	"context"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/niconiconainu/mautrix-zalo/pkg/connector/zalodb"
+)
+
+// makeAvatar creates an avatar that is downloaded from a Zalo CDN URL, or removed if the URL is empty.
+// Avatars that were already uploaded for another ghost or room are reused from the media cache.
+func (c *ZaloClient) makeAvatar(ctx context.Context, avatarURL string) *bridgev2.Avatar {
+	if avatarURL == "" {
+		return &bridgev2.Avatar{Remove: true}
+	}
+	avatar := &bridgev2.Avatar{
+		ID: makeAvatarID(avatarURL),
+		Get: func(ctx context.Context) ([]byte, error) {
+			return c.connector.Media.download(ctx, avatarURL, maxAvatarSize)
+		},
+	}
+	// Avatars are uploaded without a room, so they're never encrypted
+	cached, err := c.connector.DB.Media.Get(ctx, string(avatar.ID), false)
+	if err != nil {
+		c.log.Warn().Err(err).Str("avatar_id", string(avatar.ID)).Msg("Failed to get cached avatar")
+	} else if cached != nil {
+		avatar.MXC = cached.MXC
+		avatar.Hash = cached.Hash
+	}
+	return avatar
+}
+
+// makeAvatarID derives a stable avatar ID from a Zalo CDN URL, which doubles as its media cache key.
+func makeAvatarID(avatarURL string) networkid.AvatarID {
+	return networkid.AvatarID(mediaURLKey(avatarURL))
+}
+
+// cacheGhostAvatar returns a UserInfo.ExtraUpdates hook that adds the avatar bridgev2
+// uploaded for a ghost to the media cache.
+func (c *ZaloClient) cacheGhostAvatar(avatar *bridgev2.Avatar) bridgev2.ExtraUpdater[*bridgev2.Ghost] {
+	return func(ctx context.Context, ghost *bridgev2.Ghost) bool {
+		c.cacheAvatar(ctx, avatar, ghost.AvatarID, ghost.AvatarMXC, ghost.AvatarHash)
+		return false
+	}
+}
+
+// cachePortalAvatar returns a ChatInfo.ExtraUpdates hook that adds the avatar bridgev2
+// uploaded for a room to the media cache.
+func (c *ZaloClient) cachePortalAvatar(avatar *bridgev2.Avatar) bridgev2.ExtraUpdater[*bridgev2.Portal] {
+	return func(ctx context.Context, portal *bridgev2.Portal) bool {
+		c.cacheAvatar(ctx, avatar, portal.AvatarID, portal.AvatarMXC, portal.AvatarHash)
+		return false
+	}
+}
+
+// cacheAvatar stores an avatar upload, unless it came from the cache in the first place
+// or the avatar wasn't applied.
+func (c *ZaloClient) cacheAvatar(ctx context.Context, avatar *bridgev2.Avatar, currentID networkid.AvatarID, mxc id.ContentURIString, hash [32]byte) {
+	if avatar == nil || avatar.Remove || avatar.MXC != "" || currentID != avatar.ID || mxc == "" {
+		return
+	}
+	c.connector.cacheMedia(ctx, string(avatar.ID), &zalodb.Media{MXC: mxc, Hash: hash})
+}
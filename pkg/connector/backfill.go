@@ -0,0 +1,193 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+)
+
+// historyCursor is a position in a thread's history: a timestamp (ms) and, if known, the ID of
+// the message at it, which tells apart messages sent in the same millisecond.
+type historyCursor struct {
+	Timestamp int64
+	MsgID     string
+}
+
+func (hc historyCursor) PaginationCursor() networkid.PaginationCursor {
+	return networkid.PaginationCursor(strconv.FormatInt(hc.Timestamp, 10) + ":" + hc.MsgID)
+}
+
+// parseHistoryCursor parses a backfill cursor. Cursors stored before message IDs were added are only a timestamp.
+func parseHistoryCursor(cursor networkid.PaginationCursor) (historyCursor, error) {
+	rawTS, msgID, _ := strings.Cut(string(cursor), ":")
+	ts, err := strconv.ParseInt(rawTS, 10, 64)
+	if err != nil {
+		return historyCursor{}, fmt.Errorf("invalid backfill cursor %q: %w", cursor, err)
+	}
+	return historyCursor{Timestamp: ts, MsgID: msgID}, nil
+}
+
+// messageCursor returns the history position of a bridged message.
+func messageCursor(msg *database.Message) historyCursor {
+	return historyCursor{Timestamp: msg.Timestamp.UnixMilli(), MsgID: string(msg.ID)}
+}
+
+// FetchMessages fetches a page of history from the sidecar for backfill.
+// Backward pagination uses the position of the oldest returned message as the cursor.
+func (c *ZaloClient) FetchMessages(ctx context.Context, params bridgev2.FetchMessagesParams) (*bridgev2.FetchMessagesResponse, error) {
+	if !c.hasFeature(FeatureHistory) {
+		return &bridgev2.FetchMessagesResponse{Forward: params.Forward}, nil
+	}
+	threadID, threadType, err := ParsePortalKey(params.Portal.PortalKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var before, after historyCursor
+	if params.Forward {
+		if params.AnchorMessage != nil {
+			after = messageCursor(params.AnchorMessage)
+		}
+	} else if params.Cursor != "" {
+		before, err = parseHistoryCursor(params.Cursor)
+		if err != nil {
+			return nil, err
+		}
+	} else if params.AnchorMessage != nil {
+		before = messageCursor(params.AnchorMessage)
+	}
+
+	history, err := c.sidecar.GetHistory(ctx, threadID, threadType, before, after, params.Count)
+	if err != nil {
+		return nil, fmt.Errorf("fetch history: %w", err)
+	}
+
+	log := zerolog.Ctx(ctx)
+	messages := make([]*bridgev2.BackfillMessage, 0, len(history.Messages))
+	for i := range history.Messages {
+		msg := &ZaloRemoteMessage{data: &history.Messages[i], client: c}
+		sender := msg.GetSender()
+		intent, ok := params.Portal.GetIntentFor(ctx, sender, c.userLogin, bridgev2.RemoteEventMessage)
+		if !ok {
+			continue
+		}
+		converted, err := msg.ConvertMessage(ctx, params.Portal, intent)
+		if err != nil {
+			log.Warn().Err(err).Str("zalo_msg_id", msg.data.MsgID).Msg("Failed to convert backfill message, skipping")
+			continue
+		}
+		messages = append(messages, &bridgev2.BackfillMessage{
+			ConvertedMessage: converted,
+			Sender:           sender,
+			ID:               msg.GetID(),
+			Timestamp:        msg.GetTimestamp(),
+		})
+	}
+
+	var cursor networkid.PaginationCursor
+	if len(history.Messages) > 0 {
+		oldest := history.Messages[0]
+		cursor = historyCursor{Timestamp: oldest.Timestamp, MsgID: oldest.MsgID}.PaginationCursor()
+	}
+	return &bridgev2.FetchMessagesResponse{
+		Messages: messages,
+		Cursor:   cursor,
+		HasMore:  history.HasMore,
+		Forward:  params.Forward,
+		// Older sidecars ignore message IDs in cursors, so the anchor message may come back.
+		AggressiveDeduplication: params.Forward,
+	}, nil
+}
+
+// catchUpPortals queues a resync for every portal of this login that wasn't
+// already synced, so that forward backfill fetches anything sent while the bridge was offline.
+func (c *ZaloClient) catchUpPortals(ctx context.Context, synced map[networkid.PortalKey]struct{}, latest map[networkid.PortalKey]time.Time) {
+	if !c.hasFeature(FeatureHistory) {
+		return
+	}
+	userPortals, err := c.connector.Bridge.DB.UserPortal.GetAllForLogin(ctx, c.userLogin.UserLogin)
+	if err != nil {
+		c.log.Err(err).Msg("Failed to get portals for catch-up backfill")
+		return
+	}
+	queued := 0
+	for _, up := range userPortals {
+		if _, ok := synced[up.Portal]; ok {
+			continue
+		}
+		c.queueChatResync(up.Portal, false, latest)
+		queued++
+	}
+	c.log.Debug().Int("portal_count", queued).Msg("Queued catch-up backfill")
+}
+
+// queueChatResync queues a resync of a chat's info that also backfills any missed messages.
+// latest has the time of the latest message of recently active chats, from getConversationTimes.
+// Chats missing from it had no message among the account's recent ones, so they aren't backfilled.
+// Without the list, the sidecar is asked for messages newer than the latest bridged one.
+func (c *ZaloClient) queueChatResync(portalKey networkid.PortalKey, createPortal bool, latest map[networkid.PortalKey]time.Time) {
+	c.userLogin.QueueRemoteEvent(&simplevent.ChatResync{
+		EventMeta: simplevent.EventMeta{
+			Type:         bridgev2.RemoteEventChatResync,
+			PortalKey:    portalKey,
+			CreatePortal: createPortal,
+		},
+		CheckNeedsBackfillFunc: func(ctx context.Context, latestMessage *database.Message) (bool, error) {
+			latestTS, ok := latest[portalKey]
+			if latestMessage == nil {
+				return true, nil
+			} else if ok {
+				return latestTS.After(latestMessage.Timestamp), nil
+			} else if latest != nil {
+				return false, nil
+			}
+			return c.hasNewerMessages(ctx, portalKey, latestMessage)
+		},
+	})
+}
+
+// hasNewerMessages asks the sidecar whether a chat has messages newer than the latest bridged one.
+func (c *ZaloClient) hasNewerMessages(ctx context.Context, portalKey networkid.PortalKey, latestMessage *database.Message) (bool, error) {
+	if !c.hasFeature(FeatureHistory) {
+		return false, nil
+	}
+	threadID, threadType, err := ParsePortalKey(portalKey)
+	if err != nil {
+		return false, err
+	}
+	history, err := c.sidecar.GetHistory(ctx, threadID, threadType, historyCursor{}, messageCursor(latestMessage), 1)
+	if err != nil {
+		return false, fmt.Errorf("check for missed messages: %w", err)
+	}
+	return len(history.Messages) > 0, nil
+}
+
+// getConversationTimes returns the time of the latest message of each recently active chat,
+// or nil if the sidecar can't list them.
+func (c *ZaloClient) getConversationTimes(ctx context.Context) map[networkid.PortalKey]time.Time {
+	if !c.hasFeature(FeatureConversations) {
+		return nil
+	}
+	conversations, err := c.sidecar.GetConversations(ctx)
+	if err != nil {
+		c.log.Err(err).Msg("Failed to list recent conversations")
+		return nil
+	} else if len(conversations) == 0 {
+		// Most likely the scan failed, so don't take it as no chat having new messages
+		return nil
+	}
+	latest := make(map[networkid.PortalKey]time.Time, len(conversations))
+	c.log.Debug().Int("conversation_count", len(conversations)).Msg("Fetched recent conversations")
+	for _, conv := range conversations {
+		latest[c.makePortalKey(conv.ThreadID, conv.ThreadType)] = time.UnixMilli(conv.LastMessageTime)
+	}
+	return latest
+}
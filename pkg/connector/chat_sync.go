@@ -0,0 +1,91 @@
+package connector
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+const (
+	friendsPageSize = 100
+	// Guards against a sidecar that ignores the page parameter.
+	maxFriendsPages = 50
+)
+
+// syncChats creates portals for the user's most recently active chats, up to the configured limit,
+// and then catches up on the login's other portals.
+func (c *ZaloClient) syncChats(ctx context.Context) {
+	synced := make(map[networkid.PortalKey]struct{})
+	latest := c.getConversationTimes(ctx)
+	if limit := c.connector.Config.InitialChatLimit; limit > 0 {
+		for _, portalKey := range c.getInitialChats(ctx, limit, latest) {
+			c.queueChatResync(portalKey, true, latest)
+			synced[portalKey] = struct{}{}
+		}
+		c.log.Info().Int("chat_count", len(synced)).Msg("Queued initial chat sync")
+	}
+	c.catchUpPortals(ctx, synced, latest)
+}
+
+// getInitialChats lists the portal keys of the chats to sync, most recently active first.
+// Chats are ranked by their latest message from the conversation list, falling back to the
+// last activity of friends; groups without recent messages come last.
+// Failing to list one kind of chat is logged and doesn't prevent syncing the other.
+func (c *ZaloClient) getInitialChats(ctx context.Context, limit int, latest map[networkid.PortalKey]time.Time) []networkid.PortalKey {
+	activity := make(map[networkid.PortalKey]int64, len(latest))
+	for portalKey, ts := range latest {
+		activity[portalKey] = ts.UnixMilli()
+	}
+	if c.hasFeature(FeatureGroups) {
+		groupIDs, err := c.sidecar.GetGroupIDs(ctx)
+		if err != nil {
+			c.log.Err(err).Msg("Failed to list groups for initial sync")
+		}
+		for _, groupID := range groupIDs {
+			portalKey := c.makePortalKey(groupID, ThreadTypeGroup)
+			if _, ok := activity[portalKey]; !ok {
+				activity[portalKey] = 0
+			}
+		}
+	}
+	if c.hasFeature(FeatureFriends) {
+		friends, err := c.getAllFriends(ctx)
+		if err != nil {
+			c.log.Err(err).Msg("Failed to list friends for initial sync")
+		}
+		for _, friend := range friends {
+			portalKey := c.makePortalKey(friend.UserID, ThreadTypeUser)
+			if _, ok := activity[portalKey]; !ok {
+				activity[portalKey] = friend.LastActionTime
+			}
+		}
+	}
+
+	keys := slices.SortedFunc(maps.Keys(activity), func(a, b networkid.PortalKey) int {
+		return cmp.Or(cmp.Compare(activity[b], activity[a]), cmp.Compare(a.ID, b.ID))
+	})
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// getAllFriends pages through the friend list, returning what was fetched before any error.
+func (c *ZaloClient) getAllFriends(ctx context.Context) ([]SidecarFriend, error) {
+	var friends []SidecarFriend
+	for page := 1; page <= maxFriendsPages; page++ {
+		batch, err := c.sidecar.GetFriends(ctx, friendsPageSize, page)
+		if err != nil {
+			return friends, err
+		}
+		friends = append(friends, batch...)
+		if len(batch) < friendsPageSize {
+			break
+		}
+	}
+	return friends, nil
+}
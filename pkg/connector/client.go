@@ -2,7 +2,10 @@ package connector
 
 import (
 	"context"
+	"errors"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
@@ -18,6 +21,7 @@ var (
 	_ bridgev2.NetworkAPI                  = (*ZaloClient)(nil)
 	_ bridgev2.ReactionHandlingNetworkAPI  = (*ZaloClient)(nil)
 	_ bridgev2.RedactionHandlingNetworkAPI = (*ZaloClient)(nil)
+	_ bridgev2.BackfillingNetworkAPI       = (*ZaloClient)(nil)
 )
 
 // ZaloClient implements NetworkAPI for a single user login.
@@ -28,14 +32,20 @@ type ZaloClient struct {
 	sidecar   *SidecarClient
 
 	wsConn   *websocket.Conn
+	hello    *SidecarHello
 	wsMu     sync.Mutex
 	wsCancel context.CancelFunc
 	loggedIn bool
 	log      zerolog.Logger
+
+	cursorMu       sync.Mutex
+	lastCursorSave time.Time
+	recentMsgIDs   *messageIDWindow
 }
 
 func (c *ZaloClient) Connect(ctx context.Context) {
 	c.log = zerolog.Ctx(ctx).With().Str("component", "zalo_client").Logger()
+	c.recentMsgIDs = newMessageIDWindow()
 
 	// Try to restore session via cookie login
 	if c.meta.Cookie != "" {
@@ -52,7 +62,10 @@ func (c *ZaloClient) Connect(ctx context.Context) {
 	}
 
 	// Connect WebSocket
-	if err := c.connectWS(ctx); err != nil {
+	if err := c.connectWS(ctx); errors.Is(err, ErrSidecarIncompatible) {
+		c.reportIncompatibleSidecar(err)
+		return
+	} else if err != nil {
 		c.log.Err(err).Msg("Failed to connect WebSocket to sidecar")
 		return
 	}
@@ -63,6 +76,8 @@ func (c *ZaloClient) Connect(ctx context.Context) {
 
 	c.loggedIn = true
 	c.userLogin.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+
+	go c.syncChats(c.log.WithContext(context.Background()))
 }
 
 func (c *ZaloClient) Disconnect() {
@@ -71,11 +86,12 @@ func (c *ZaloClient) Disconnect() {
 		c.wsCancel()
 	}
 	c.wsMu.Lock()
-	defer c.wsMu.Unlock()
 	if c.wsConn != nil {
 		_ = c.wsConn.Close()
 		c.wsConn = nil
 	}
+	c.wsMu.Unlock()
+	c.saveCursor(context.Background())
 }
 
 func (c *ZaloClient) IsLoggedIn() bool {
@@ -87,12 +103,20 @@ func (c *ZaloClient) LogoutRemote(ctx context.Context) {
 	c.Disconnect()
 }
 
+// makePortalKey creates the portal key for a Zalo thread as seen by this login.
+func (c *ZaloClient) makePortalKey(threadID string, threadType int) networkid.PortalKey {
+	return MakePortalKey(threadID, threadType, c.userLogin.ID, c.connector.Bridge.Config.SplitPortals)
+}
+
 func (c *ZaloClient) IsThisUser(_ context.Context, userID networkid.UserID) bool {
 	return string(userID) == c.meta.UserID
 }
 
 func (c *ZaloClient) GetChatInfo(ctx context.Context, portal *bridgev2.Portal) (*bridgev2.ChatInfo, error) {
-	threadID, threadType := ParsePortalKey(portal.PortalKey)
+	threadID, threadType, err := ParsePortalKey(portal.PortalKey)
+	if err != nil {
+		return nil, err
+	}
 
 	if threadType == ThreadTypeGroup {
 		group, err := c.sidecar.GetGroupInfo(ctx, threadID)
@@ -102,20 +126,31 @@ func (c *ZaloClient) GetChatInfo(ctx context.Context, portal *bridgev2.Portal) (
 		memberMap := make(bridgev2.ChatMemberMap, len(group.Members))
 		for _, m := range group.Members {
 			name := m.DisplayName
+			powerLevel := powerLevelMember
+			if m.UserID == group.Creator {
+				powerLevel = powerLevelCreator
+			} else if slices.Contains(group.Admins, m.UserID) {
+				powerLevel = powerLevelAdmin
+			}
 			memberMap[networkid.UserID(m.UserID)] = bridgev2.ChatMember{
-				EventSender: bridgev2.EventSender{Sender: networkid.UserID(m.UserID)},
+				EventSender: c.makeEventSender(m.UserID),
 				Membership:  event.MembershipJoin,
 				Nickname:    &name,
+				PowerLevel:  &powerLevel,
+				UserInfo:    c.makeMemberUserInfo(ctx, &m),
 			}
 		}
 		roomType := database.RoomTypeDefault
+		avatar := c.makeAvatar(ctx, group.Avatar)
 		return &bridgev2.ChatInfo{
-			Name: &group.Name,
+			Name:   &group.Name,
+			Avatar: avatar,
 			Members: &bridgev2.ChatMemberList{
 				IsFull:    true,
 				MemberMap: memberMap,
 			},
-			Type: &roomType,
+			Type:         &roomType,
+			ExtraUpdates: c.cachePortalAvatar(avatar),
 		}, nil
 	}
 
@@ -125,17 +160,19 @@ func (c *ZaloClient) GetChatInfo(ctx context.Context, portal *bridgev2.Portal) (
 		return nil, err
 	}
 	roomType := database.RoomTypeDM
+	otherUserID := MakeUserID(threadID)
 	return &bridgev2.ChatInfo{
 		Name: &user.DisplayName,
 		Members: &bridgev2.ChatMemberList{
 			IsFull: true,
 			MemberMap: bridgev2.ChatMemberMap{
-				networkid.UserID(user.ID): {
-					EventSender: bridgev2.EventSender{Sender: networkid.UserID(user.ID)},
+				otherUserID: {
+					EventSender: bridgev2.EventSender{Sender: otherUserID},
 					Membership:  event.MembershipJoin,
+					UserInfo:    c.makeUserInfo(ctx, user),
 				},
 			},
-			OtherUserID: networkid.UserID(user.ID),
+			OtherUserID: otherUserID,
 		},
 		Type: &roomType,
 	}, nil
@@ -146,11 +183,59 @@ func (c *ZaloClient) GetUserInfo(ctx context.Context, ghost *bridgev2.Ghost) (*b
 	if err != nil {
 		return nil, err
 	}
+	return c.makeUserInfo(ctx, user), nil
+}
+
+// makeUserInfo converts a sidecar user profile into ghost info.
+func (c *ZaloClient) makeUserInfo(ctx context.Context, user *SidecarUserInfoResponse) *bridgev2.UserInfo {
+	avatar := c.makeAvatar(ctx, user.AvatarURL)
 	return &bridgev2.UserInfo{
-		Name: &user.DisplayName,
-	}, nil
+		Name:         &user.DisplayName,
+		Avatar:       avatar,
+		ExtraUpdates: c.cacheGhostAvatar(avatar),
+	}
+}
+
+// makeMemberUserInfo returns ghost info for a group member, or nil if the sidecar didn't include any.
+func (c *ZaloClient) makeMemberUserInfo(ctx context.Context, m *SidecarGroupMember) *bridgev2.UserInfo {
+	var info bridgev2.UserInfo
+	if m.DisplayName != "" {
+		info.Name = &m.DisplayName
+	}
+	if m.Avatar != "" {
+		info.Avatar = c.makeAvatar(ctx, m.Avatar)
+		info.ExtraUpdates = c.cacheGhostAvatar(info.Avatar)
+	}
+	if info.Name == nil && info.Avatar == nil {
+		return nil
+	}
+	return &info
 }
 
+// GetCapabilities lists the media Zalo accepts, so bridgev2 lets those messages through.
+// Stickers without a Zalo sticker ID and GIFs are sent as images, other audio as files.
 func (c *ZaloClient) GetCapabilities(_ context.Context, _ *bridgev2.Portal) *event.RoomFeatures {
-	return &event.RoomFeatures{}
+	media := &c.connector.Config.Media
+	fileFeatures := func(mimeTypes string, kind mediaKind) *event.FileFeatures {
+		return &event.FileFeatures{
+			MimeTypes: map[string]event.CapabilitySupportLevel{mimeTypes: event.CapLevelFullySupported},
+			MaxSize:   media.maxSize(kind),
+		}
+	}
+	// Images are sent with their caption
+	captioned := func(features *event.FileFeatures) *event.FileFeatures {
+		features.Caption = event.CapLevelFullySupported
+		return features
+	}
+	return &event.RoomFeatures{
+		File: event.FileFeatureMap{
+			event.MsgImage:      captioned(fileFeatures("image/*", mediaKindImage)),
+			event.CapMsgGIF:     captioned(fileFeatures("image/*", mediaKindImage)),
+			event.CapMsgSticker: fileFeatures("image/*", mediaKindImage),
+			event.MsgVideo:      fileFeatures("video/*", mediaKindVideo),
+			event.CapMsgVoice:   fileFeatures("audio/*", mediaKindVoice),
+			event.MsgAudio:      fileFeatures("*/*", mediaKindFile),
+			event.MsgFile:       fileFeatures("*/*", mediaKindFile),
+		},
+	}
 }
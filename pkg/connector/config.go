@@ -6,7 +6,36 @@ import (
 
 // ZaloConfig holds network-specific bridge configuration.
 type ZaloConfig struct {
-	SidecarURL string `yaml:"sidecar_url" json:"sidecar_url"`
+	SidecarURL       string               `yaml:"sidecar_url" json:"sidecar_url"`
+	Sidecar          SidecarProcessConfig `yaml:"sidecar" json:"sidecar"`
+	InitialChatLimit int                  `yaml:"initial_chat_limit" json:"initial_chat_limit"`
+	Media            MediaConfig          `yaml:"media" json:"media"`
+}
+
+// MediaConfig limits the size of media bridged in either direction, in megabytes. 0 means no limit.
+type MediaConfig struct {
+	MaxImageSize int `yaml:"max_image_size" json:"max_image_size"`
+	MaxVideoSize int `yaml:"max_video_size" json:"max_video_size"`
+	MaxVoiceSize int `yaml:"max_voice_size" json:"max_voice_size"`
+	MaxFileSize  int `yaml:"max_file_size" json:"max_file_size"`
+	// Outgoing images wider or taller than this many pixels are scaled down. 0 means no limit.
+	MaxImageDimension int `yaml:"max_image_dimension" json:"max_image_dimension"`
+
+	// Hosts (and their subdomains) media may be downloaded from. Empty means DefaultMediaHosts.
+	AllowedHosts []string `yaml:"allowed_hosts" json:"allowed_hosts"`
+	// Timeout for a whole media download, in seconds.
+	DownloadTimeout int `yaml:"download_timeout" json:"download_timeout"`
+	// ffmpeg binary for transcoding voice messages and converting animated stickers. Empty means ffmpeg from $PATH.
+	FFmpegPath string `yaml:"ffmpeg_path" json:"ffmpeg_path"`
+}
+
+// SidecarProcessConfig controls whether the bridge launches and supervises the sidecar itself.
+type SidecarProcessConfig struct {
+	Managed        bool   `yaml:"managed" json:"managed"`
+	NodePath       string `yaml:"node_path" json:"node_path"`
+	ScriptPath     string `yaml:"script_path" json:"script_path"`
+	WorkDir        string `yaml:"work_dir" json:"work_dir"`
+	StartupTimeout int    `yaml:"startup_timeout" json:"startup_timeout"`
 }
 
 // UserLoginMetadata stores Zalo credentials for session persistence in the bridge DB.
@@ -15,15 +44,81 @@ type UserLoginMetadata struct {
 	IMEI      string `json:"imei"`
 	UserAgent string `json:"user_agent"`
 	UserID    string `json:"user_id"`
+
+	// Last sidecar event acknowledged by the bridge, used to request replay after reconnecting.
+	EventEpoch  string `json:"event_epoch,omitempty"`
+	EventCursor int64  `json:"event_cursor,omitempty"`
+}
+
+// MessageMetadata stores what Zalo needs to quote a bridged message in a reply,
+// and the last known media link of messages bridged with direct media.
+type MessageMetadata struct {
+	CliMsgID string `json:"cli_msg_id,omitempty"`
+	MsgType  string `json:"msg_type,omitempty"`
+	Content  string `json:"content,omitempty"`
+	MediaURL string `json:"media_url,omitempty"`
+	// Set once refreshing an expired MediaURL failed, so later requests don't search again
+	MediaGone bool `json:"media_gone,omitempty"`
 }
 
 const configExample = `
     # URL of the Node.js sidecar process
     sidecar_url: http://localhost:3500
+    # Let the bridge launch the sidecar itself instead of running it separately.
+    # The sidecar will listen on the port from sidecar_url.
+    sidecar:
+        # Whether to start and supervise the sidecar process.
+        managed: false
+        # Path to the node binary.
+        node_path: node
+        # Path to the compiled sidecar entry point.
+        script_path: sidecar/dist/index.js
+        # Working directory for the sidecar process. Empty means the bridge's working directory.
+        work_dir: ""
+        # How long to wait for the sidecar to pass its health check on startup, in seconds.
+        startup_timeout: 60
+    # Maximum number of chats (groups and DMs, most recently active first) to create
+    # portals for when connecting. Set to 0 to only create portals when messages arrive.
+    initial_chat_limit: 50
+    # Maximum size of media to bridge in either direction, in megabytes. 0 means no limit.
+    # Media is streamed through temporary files, so these bound disk usage and transfer time
+    # rather than memory. Larger files are replaced with a notice in the room.
+    media:
+        max_image_size: 25
+        max_video_size: 100
+        max_voice_size: 25
+        max_file_size: 100
+        # Images sent to Zalo that are wider or taller than this many pixels are scaled down.
+        # Formats Zalo doesn't show well, like WebP, are converted to JPEG or PNG. 0 means no limit.
+        max_image_dimension: 2560
+        # Hosts that incoming media may be downloaded from, including their subdomains.
+        # Media URLs come from Zalo messages, so anything else is refused, as are private
+        # and loopback addresses. Empty means the Zalo CDN domains.
+        allowed_hosts: [zdn.vn, zadn.vn, zalo.me, zaloapp.com, dlfl.vn]
+        # How long a single media download may take, in seconds.
+        download_timeout: 300
+        # Path to ffmpeg, used to transcode voice messages between Zalo's AAC and Matrix's Ogg/Opus
+        # and to convert animated stickers to GIF. Empty means ffmpeg from $PATH. If it can't be
+        # found, voice messages are bridged as plain files in both directions.
+        ffmpeg_path: ""
 `
 
 type zaloConfigUpgrader struct{}
 
 func (z *zaloConfigUpgrader) DoUpgrade(helper configupgrade.Helper) {
 	helper.Copy(configupgrade.Str, "sidecar_url")
+	helper.Copy(configupgrade.Bool, "sidecar", "managed")
+	helper.Copy(configupgrade.Str, "sidecar", "node_path")
+	helper.Copy(configupgrade.Str, "sidecar", "script_path")
+	helper.Copy(configupgrade.Str, "sidecar", "work_dir")
+	helper.Copy(configupgrade.Int, "sidecar", "startup_timeout")
+	helper.Copy(configupgrade.Int, "initial_chat_limit")
+	helper.Copy(configupgrade.Int, "media", "max_image_size")
+	helper.Copy(configupgrade.Int, "media", "max_video_size")
+	helper.Copy(configupgrade.Int, "media", "max_voice_size")
+	helper.Copy(configupgrade.Int, "media", "max_file_size")
+	helper.Copy(configupgrade.Int, "media", "max_image_dimension")
+	helper.Copy(configupgrade.List, "media", "allowed_hosts")
+	helper.Copy(configupgrade.Int, "media", "download_timeout")
+	helper.Copy(configupgrade.Str, "media", "ffmpeg_path")
 }
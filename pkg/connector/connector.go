@@ -2,32 +2,106 @@ package connector
 
 import (
 	"context"
+	"fmt"
 
 	"go.mau.fi/util/configupgrade"
 	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/commands"
 	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/networkid"
+
+	"github.com/niconiconainu/mautrix-zalo/pkg/connector/zalodb"
 )
 
 // Compile-time interface checks
 var (
 	_ bridgev2.NetworkConnector = (*ZaloConnector)(nil)
+	_ bridgev2.StoppableNetwork = (*ZaloConnector)(nil)
 )
 
 // ZaloConnector implements bridgev2.NetworkConnector for the Zalo network.
 type ZaloConnector struct {
 	Bridge *bridgev2.Bridge
 	Config ZaloConfig
+	DB     *zalodb.Database
+	Media  *mediaFetcher
+
+	sidecarProc *SidecarProcess
+	directMedia bool
 }
 
 func (z *ZaloConnector) Init(bridge *bridgev2.Bridge) {
 	z.Bridge = bridge
+	z.DB = zalodb.New(bridge.ID, bridge.DB.Database, bridge.Log.With().Str("db_section", "zalo").Logger())
+	z.Media = newMediaFetcher(&z.Config.Media)
+	if proc, ok := bridge.Commands.(*commands.Processor); ok {
+		proc.AddHandlers(cmdStickers)
+	}
 }
 
-func (z *ZaloConnector) Start(_ context.Context) error {
+func (z *ZaloConnector) Start(ctx context.Context) error {
+	if err := z.DB.Upgrade(ctx); err != nil {
+		return bridgev2.DBUpgradeError{Err: err, Section: "zalo"}
+	}
+	z.setupFFmpeg()
+	if z.Config.Sidecar.Managed {
+		if err := z.startSidecar(ctx); err != nil {
+			return err
+		}
+	}
+	return z.checkSidecarVersion(ctx)
+}
+
+// startSidecar launches the managed sidecar and waits for it to become healthy.
+func (z *ZaloConnector) startSidecar(ctx context.Context) error {
+	log := z.Bridge.Log.With().Str("component", "sidecar_process").Logger()
+	proc := NewSidecarProcess(z.Config.Sidecar, z.Config.SidecarURL, log)
+	if err := proc.Start(); err != nil {
+		return err
+	}
+	if err := proc.WaitHealthy(ctx, NewSidecarClient(z.Config.SidecarURL, "")); err != nil {
+		proc.Stop()
+		return err
+	}
+	z.sidecarProc = proc
+	log.Info().Msg("Sidecar is healthy")
 	return nil
 }
 
+// checkSidecarVersion refuses to start against a sidecar speaking another protocol version.
+// An unreachable external sidecar is only logged, as it may come up after the bridge.
+func (z *ZaloConnector) checkSidecarVersion(ctx context.Context) error {
+	hello, err := NewSidecarClient(z.Config.SidecarURL, "").GetVersion(ctx)
+	if err != nil {
+		if z.Config.Sidecar.Managed {
+			if z.sidecarProc != nil {
+				z.sidecarProc.Stop()
+			}
+			return fmt.Errorf("failed to get sidecar version: %w", err)
+		}
+		z.Bridge.Log.Warn().Err(err).Msg("Couldn't check sidecar version, will retry on connect")
+		return nil
+	}
+	if err = hello.Check(); err != nil {
+		if z.sidecarProc != nil {
+			z.sidecarProc.Stop()
+		}
+		return err
+	}
+	z.Bridge.Log.Info().
+		Int("protocol_version", hello.ProtocolVersion).
+		Str("sidecar_version", hello.SidecarVersion).
+		Str("zca_js_version", hello.ZcaJSVersion).
+		Msg("Sidecar version is compatible")
+	return nil
+}
+
+func (z *ZaloConnector) Stop() {
+	if z.sidecarProc != nil {
+		z.sidecarProc.Stop()
+	}
+}
+
 func (z *ZaloConnector) GetName() bridgev2.BridgeName {
 	return bridgev2.BridgeName{
 		DisplayName:      "Zalo",
@@ -50,6 +124,7 @@ func (z *ZaloConnector) GetConfig() (example string, data any, upgrader configup
 func (z *ZaloConnector) GetDBMetaTypes() database.MetaTypes {
 	return database.MetaTypes{
 		UserLogin: func() any { return &UserLoginMetadata{} },
+		Message:   func() any { return &MessageMetadata{} },
 	}
 }
 
@@ -73,7 +148,7 @@ func (z *ZaloConnector) CreateLogin(_ context.Context, user *bridgev2.User, flow
 
 func (z *ZaloConnector) LoadUserLogin(_ context.Context, login *bridgev2.UserLogin) error {
 	meta := login.Metadata.(*UserLoginMetadata)
-	sidecar := NewSidecarClient(z.Config.SidecarURL)
+	sidecar := NewSidecarClient(z.Config.SidecarURL, string(login.ID))
 	login.Client = &ZaloClient{
 		connector: z,
 		userLogin: login,
@@ -83,8 +158,10 @@ func (z *ZaloConnector) LoadUserLogin(_ context.Context, login *bridgev2.UserLog
 	return nil
 }
 
+// GetBridgeInfoVersion versions the bridge info and room features. Bump capabilities whenever
+// GetCapabilities changes, so bridgev2 sends the new features to existing rooms.
 func (z *ZaloConnector) GetBridgeInfoVersion() (info, capabilities int) {
-	return 1, 1
+	return 1, 5
 }
 
 // MakeUserLoginID creates a UserLoginID from Zalo UID.
@@ -0,0 +1,237 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/mediaproxy"
+)
+
+var _ bridgev2.DirectMediableNetwork = (*ZaloConnector)(nil)
+
+// directMediaVersion is the first byte of direct media IDs, so the format can change later.
+const directMediaVersion = 1
+
+// refreshWindow is how far around a message's timestamp its history is searched when
+// refreshing an expired media link.
+const refreshWindow = 1000
+
+// directMediaID identifies the media of a Zalo message. Content URIs are limited to 255
+// characters, too short for Zalo CDN URLs, so the ID points at the message instead: the
+// current URL is read from its metadata, or fetched again through the sidecar if it expired.
+type directMediaID struct {
+	LoginID    networkid.UserLoginID
+	ThreadID   string
+	ThreadType int
+	MsgID      string
+	Timestamp  int64
+	Kind       mediaKind
+}
+
+func (d *directMediaID) MediaID() networkid.MediaID {
+	buf := []byte{directMediaVersion}
+	for _, field := range []string{string(d.LoginID), d.ThreadID, d.MsgID, string(d.Kind)} {
+		buf = binary.AppendUvarint(buf, uint64(len(field)))
+		buf = append(buf, field...)
+	}
+	buf = binary.AppendVarint(buf, int64(d.ThreadType))
+	buf = binary.AppendVarint(buf, d.Timestamp)
+	return networkid.MediaID(buf)
+}
+
+func parseDirectMediaID(mediaID networkid.MediaID) (*directMediaID, error) {
+	r := bytes.NewReader(mediaID)
+	if version, err := r.ReadByte(); err != nil || version != directMediaVersion {
+		return nil, fmt.Errorf("%w: unknown version", mediaproxy.ErrInvalidMediaIDSyntax)
+	}
+	var fields [4]string
+	for i := range fields {
+		length, err := binary.ReadUvarint(r)
+		if err != nil || length > uint64(r.Len()) {
+			return nil, mediaproxy.ErrInvalidMediaIDSyntax
+		}
+		field := make([]byte, length)
+		if _, err = io.ReadFull(r, field); err != nil {
+			return nil, mediaproxy.ErrInvalidMediaIDSyntax
+		}
+		fields[i] = string(field)
+	}
+	threadType, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, mediaproxy.ErrInvalidMediaIDSyntax
+	}
+	timestamp, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, mediaproxy.ErrInvalidMediaIDSyntax
+	}
+	return &directMediaID{
+		LoginID:    networkid.UserLoginID(fields[0]),
+		ThreadID:   fields[1],
+		ThreadType: int(threadType),
+		MsgID:      fields[2],
+		Kind:       mediaKind(fields[3]),
+		Timestamp:  timestamp,
+	}, nil
+}
+
+func (z *ZaloConnector) SetUseDirectMedia() {
+	z.directMedia = true
+}
+
+// Download serves direct media requests by streaming the file from the Zalo CDN.
+func (z *ZaloConnector) Download(ctx context.Context, mediaID networkid.MediaID, _ map[string]string) (mediaproxy.GetMediaResponse, error) {
+	dmID, err := parseDirectMediaID(mediaID)
+	if err != nil {
+		return nil, err
+	}
+	login := z.Bridge.GetCachedUserLoginByID(dmID.LoginID)
+	if login == nil {
+		return nil, mautrix.MNotFound.WithMessage("Login not found")
+	}
+	client, ok := login.Client.(*ZaloClient)
+	if !ok || !client.IsLoggedIn() {
+		return nil, mautrix.MNotFound.WithMessage("Login is not connected to Zalo")
+	}
+	return client.downloadDirectMedia(ctx, dmID)
+}
+
+// downloadDirectMedia opens the media of a message, refreshing its link if the stored one expired.
+func (c *ZaloClient) downloadDirectMedia(ctx context.Context, dmID *directMediaID) (mediaproxy.GetMediaResponse, error) {
+	log := zerolog.Ctx(ctx).With().Str("zalo_msg_id", dmID.MsgID).Logger()
+	portalKey := c.makePortalKey(dmID.ThreadID, dmID.ThreadType)
+	msg, err := c.connector.Bridge.DB.Message.GetFirstPartByID(ctx, portalKey.Receiver, networkid.MessageID(dmID.MsgID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message: %w", err)
+	}
+	if msg == nil {
+		return nil, mautrix.MNotFound.WithMessage("Message not found")
+	}
+	meta, _ := msg.Metadata.(*MessageMetadata)
+	if meta != nil && meta.MediaGone {
+		return nil, errMediaNotRefreshable
+	}
+
+	maxSize := c.connector.Config.Media.maxSize(dmID.Kind)
+	if meta != nil && meta.MediaURL != "" {
+		resp, err := c.connector.Media.open(ctx, meta.MediaURL, dmID.Kind, maxSize)
+		if err == nil {
+			return directMediaResponse(resp.Body, resp.Header.Get("Content-Type"), resp.ContentLength, dmID.Kind, maxSize), nil
+		} else if !errors.Is(err, errMediaGone) {
+			return nil, err
+		}
+		log.Debug().Err(err).Msg("Stored media link expired, refreshing")
+	}
+
+	mediaURL, err := c.refreshMediaURL(ctx, dmID)
+	if errors.Is(err, errMediaNotRefreshable) && meta != nil {
+		meta.MediaGone = true
+		if updateErr := c.connector.Bridge.DB.Message.Update(ctx, msg); updateErr != nil {
+			log.Warn().Err(updateErr).Msg("Failed to save that media link can't be refreshed")
+		}
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	if meta != nil && meta.MediaURL != mediaURL {
+		meta.MediaURL = mediaURL
+		if err = c.connector.Bridge.DB.Message.Update(ctx, msg); err != nil {
+			log.Warn().Err(err).Msg("Failed to save refreshed media link")
+		}
+	}
+	resp, err := c.connector.Media.open(ctx, mediaURL, dmID.Kind, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return directMediaResponse(resp.Body, resp.Header.Get("Content-Type"), resp.ContentLength, dmID.Kind, maxSize), nil
+}
+
+// errMediaNotRefreshable is returned when the message of expired media can't be found again.
+var errMediaNotRefreshable = mautrix.MNotFound.WithMessage("Media link expired and the message is too old to refresh it")
+
+// refreshMediaURL fetches the message again through the sidecar, which gets a fresh media link from Zalo.
+// Zalo has no API to fetch a single message, so this searches the history around its timestamp, which
+// only reaches back a few hundred messages per thread type (see getHistory in the sidecar). Media of
+// older messages can't be refreshed once its link expires.
+func (c *ZaloClient) refreshMediaURL(ctx context.Context, dmID *directMediaID) (string, error) {
+	history, err := c.sidecar.GetHistory(ctx, dmID.ThreadID, dmID.ThreadType,
+		historyCursor{Timestamp: dmID.Timestamp + refreshWindow}, historyCursor{Timestamp: dmID.Timestamp - refreshWindow}, 50)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch message to refresh media link: %w", err)
+	}
+	for _, msg := range history.Messages {
+		if msg.MsgID == dmID.MsgID && msg.MediaURL != "" {
+			return msg.MediaURL, nil
+		}
+	}
+	return "", errMediaNotRefreshable
+}
+
+// directMediaResponse streams a download to the media proxy, cutting it off with an error past max.
+func directMediaResponse(body io.ReadCloser, contentType string, size int64, kind mediaKind, max int64) mediaproxy.GetMediaResponse {
+	if max > 0 {
+		body = &limitedBody{ReadCloser: body, remaining: max, kind: kind, max: max}
+	}
+	return &mediaproxy.GetMediaResponseData{
+		Reader:        body,
+		ContentType:   contentType,
+		ContentLength: size,
+	}
+}
+
+// limitedBody is a response body that fails with a mediaTooLargeError once more than max bytes were read.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	kind      mediaKind
+	max       int64
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.remaining < 0 {
+		return 0, &mediaTooLargeError{kind: lb.kind, size: -1, max: lb.max}
+	}
+	if int64(len(p)) > lb.remaining+1 {
+		p = p[:lb.remaining+1]
+	}
+	n, err := lb.ReadCloser.Read(p)
+	lb.remaining -= int64(n)
+	if lb.remaining < 0 {
+		return n, &mediaTooLargeError{kind: lb.kind, size: -1, max: lb.max}
+	}
+	return n, err
+}
+
+// directMedia points a message's media at the bridge's media proxy instead of uploading it.
+// Files over the size limit are rejected up front if Zalo reported their size.
+func (m *ZaloRemoteMessage) directMedia(ctx context.Context, portal *bridgev2.Portal, fileName, mimeType string, kind mediaKind) (*uploadedMedia, error) {
+	connector := m.client.connector
+	if err := checkSize(kind, int64(m.data.FileSize), connector.Config.Media.maxSize(kind)); err != nil {
+		return nil, err
+	}
+	dmID := &directMediaID{
+		LoginID:    m.client.userLogin.ID,
+		ThreadID:   m.data.ThreadID,
+		ThreadType: m.data.ThreadType,
+		MsgID:      m.data.MsgID,
+		Timestamp:  m.data.Timestamp,
+		Kind:       kind,
+	}
+	mxc, err := portal.Bridge.Matrix.GenerateContentURI(ctx, dmID.MediaID())
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate direct media URI: %w", err)
+	}
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(filepath.Ext(fileName))
+	}
+	return &uploadedMedia{URL: mxc, MimeType: mimeType, Size: int64(m.data.FileSize)}, nil
+}
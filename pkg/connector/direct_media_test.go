@@ -0,0 +1,47 @@
+package connector
+
+import (
+	"errors"
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/mediaproxy"
+)
+
+func TestDirectMediaIDRoundTrip(t *testing.T) {
+	tests := []directMediaID{
+		{LoginID: "123", ThreadID: "456", ThreadType: ThreadTypeUser, MsgID: "789", Timestamp: 1700000000000, Kind: mediaKindImage},
+		{LoginID: "123", ThreadID: "456", ThreadType: ThreadTypeGroup, MsgID: "789", Timestamp: 0, Kind: mediaKindVideo},
+		{LoginID: "", ThreadID: "", MsgID: "", Kind: ""},
+		{LoginID: "a:b", ThreadID: "tiếng việt", ThreadType: ThreadTypeGroup, MsgID: "x\x00y", Timestamp: -1, Kind: mediaKindFile},
+	}
+	for _, want := range tests {
+		got, err := parseDirectMediaID(want.MediaID())
+		if err != nil {
+			t.Errorf("parseDirectMediaID(%+v) returned error: %v", want, err)
+			continue
+		}
+		if *got != want {
+			t.Errorf("round trip = %+v, want %+v", *got, want)
+		}
+	}
+}
+
+func TestParseDirectMediaIDInvalid(t *testing.T) {
+	valid := (&directMediaID{LoginID: "123", ThreadID: "456", MsgID: "789", Kind: mediaKindImage}).MediaID()
+	tests := map[string]networkid.MediaID{
+		"empty":             nil,
+		"unknown version":   append(networkid.MediaID{directMediaVersion + 1}, valid[1:]...),
+		"truncated field":   valid[:5],
+		"missing numbers":   valid[:len(valid)-2],
+		"oversized field":   {directMediaVersion, 0x7f, 'a'},
+		"overflowing field": {directMediaVersion, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+	}
+	for name, mediaID := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseDirectMediaID(mediaID); !errors.Is(err, mediaproxy.ErrInvalidMediaIDSyntax) {
+				t.Errorf("parseDirectMediaID() error = %v, want ErrInvalidMediaIDSyntax", err)
+			}
+		})
+	}
+}
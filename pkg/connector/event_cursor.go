@@ -0,0 +1,101 @@
+package connector
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	recentMessageIDLimit = 1000
+	cursorSaveInterval   = 5 * time.Second
+)
+
+// messageIDWindow remembers recently seen message IDs so replayed duplicates can be dropped.
+type messageIDWindow struct {
+	ids   map[string]struct{}
+	order []string
+}
+
+func newMessageIDWindow() *messageIDWindow {
+	return &messageIDWindow{
+		ids:   make(map[string]struct{}, recentMessageIDLimit),
+		order: make([]string, 0, recentMessageIDLimit),
+	}
+}
+
+// Add records a message ID and reports whether it hadn't been seen before.
+func (w *messageIDWindow) Add(msgID string) bool {
+	if _, seen := w.ids[msgID]; seen {
+		return false
+	}
+	if len(w.order) >= recentMessageIDLimit {
+		delete(w.ids, w.order[0])
+		w.order = w.order[1:]
+	}
+	w.ids[msgID] = struct{}{}
+	w.order = append(w.order, msgID)
+	return true
+}
+
+// resumeEvents asks the sidecar to replay events after the last acknowledged cursor.
+// A new epoch means the sidecar session was recreated, so the old cursor no longer applies.
+func (c *ZaloClient) resumeEvents(conn *websocket.Conn, hello *SidecarHello) error {
+	c.cursorMu.Lock()
+	if hello.Epoch != c.meta.EventEpoch {
+		c.log.Info().
+			Str("old_epoch", c.meta.EventEpoch).
+			Str("new_epoch", hello.Epoch).
+			Msg("Sidecar session changed, resetting event cursor")
+		c.meta.EventEpoch = hello.Epoch
+		c.meta.EventCursor = 0
+	}
+	since := c.meta.EventCursor
+	c.cursorMu.Unlock()
+
+	c.log.Debug().Int64("since", since).Msg("Requesting event replay from sidecar")
+	return conn.WriteJSON(map[string]any{
+		"type":  "resume",
+		"since": since,
+	})
+}
+
+// isReplayedEvent reports whether an event was already acknowledged.
+func (c *ZaloClient) isReplayedEvent(seq int64) bool {
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	return seq != 0 && seq <= c.meta.EventCursor
+}
+
+// ackEvent acknowledges a queued event to the sidecar and advances the persisted cursor.
+// The cursor is saved at most every cursorSaveInterval; Disconnect flushes the rest.
+func (c *ZaloClient) ackEvent(ctx context.Context, conn *websocket.Conn, seq int64) {
+	if seq == 0 {
+		return
+	}
+	if err := conn.WriteJSON(map[string]any{"type": "ack", "seq": seq}); err != nil {
+		c.log.Warn().Err(err).Int64("seq", seq).Msg("Failed to acknowledge sidecar event")
+	}
+
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	c.meta.EventCursor = seq
+	if time.Since(c.lastCursorSave) >= cursorSaveInterval {
+		c.saveCursorLocked(ctx)
+	}
+}
+
+// saveCursor persists the event cursor immediately.
+func (c *ZaloClient) saveCursor(ctx context.Context) {
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	c.saveCursorLocked(ctx)
+}
+
+func (c *ZaloClient) saveCursorLocked(ctx context.Context) {
+	c.lastCursorSave = time.Now()
+	if err := c.userLogin.Save(ctx); err != nil {
+		c.log.Err(err).Msg("Failed to save event cursor")
+	}
+}
@@ -3,10 +3,13 @@ package connector
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"maunium.net/go/mautrix/bridgev2/status"
 )
 
 // SidecarEvent is the WebSocket envelope from the sidecar.
@@ -14,21 +17,51 @@ type SidecarEvent struct {
 	Type      string          `json:"type"`
 	Data      json.RawMessage `json:"data"`
 	Timestamp int64           `json:"timestamp"`
+	Seq       int64           `json:"seq,omitempty"`
 }
 
-// connectWS dials the sidecar WebSocket endpoint.
+// connectWS dials the sidecar WebSocket endpoint and performs the protocol handshake.
 func (c *ZaloClient) connectWS(ctx context.Context) error {
 	wsURL := strings.Replace(c.sidecar.baseURL, "http", "ws", 1) + "/ws"
-	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, c.sidecar.sessionHeader())
 	if err != nil {
 		return err
 	}
+	hello, err := readHandshake(conn)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	c.log.Info().
+		Int("protocol_version", hello.ProtocolVersion).
+		Str("sidecar_version", hello.SidecarVersion).
+		Str("zca_js_version", hello.ZcaJSVersion).
+		Strs("features", hello.Features).
+		Msg("Sidecar handshake complete")
+	if missing := hello.MissingFeatures(); len(missing) > 0 {
+		c.log.Warn().Strs("features", missing).Msg("Sidecar doesn't support some features, disabling them")
+	}
+	if hello.HasFeature(FeatureReplay) {
+		if err = c.resumeEvents(conn, hello); err != nil {
+			_ = conn.Close()
+			return fmt.Errorf("request event replay: %w", err)
+		}
+	}
+
 	c.wsMu.Lock()
 	c.wsConn = conn
+	c.hello = hello
 	c.wsMu.Unlock()
 	return nil
 }
 
+// hasFeature reports whether the connected sidecar supports the given feature.
+func (c *ZaloClient) hasFeature(feature string) bool {
+	c.wsMu.Lock()
+	defer c.wsMu.Unlock()
+	return c.hello.HasFeature(feature)
+}
+
 // wsReadLoop reads events from sidecar WS and dispatches them.
 func (c *ZaloClient) wsReadLoop(ctx context.Context) {
 	for {
@@ -61,7 +94,12 @@ func (c *ZaloClient) wsReadLoop(ctx context.Context) {
 			continue
 		}
 
+		if c.isReplayedEvent(evt.Seq) {
+			c.log.Debug().Int64("seq", evt.Seq).Msg("Skipping already acknowledged sidecar event")
+			continue
+		}
 		c.handleSidecarEvent(ctx, &evt)
+		c.ackEvent(ctx, conn, evt.Seq)
 	}
 }
 
@@ -74,8 +112,10 @@ func (c *ZaloClient) handleSidecarEvent(ctx context.Context, evt *SidecarEvent)
 		c.handleReactionEvent(ctx, evt.Data)
 	case "undo":
 		c.handleUndoEvent(ctx, evt.Data)
+	case "connection":
+		c.log.Debug().RawJSON("data", evt.Data).Msg("Received repeated sidecar handshake")
 	case "group_event":
-		c.log.Debug().RawJSON("data", evt.Data).Msg("[DISCOVERY] Group event received")
+		c.handleGroupEvent(ctx, evt.Data)
 	default:
 		c.log.Warn().Str("type", evt.Type).Msg("Unknown sidecar event type")
 	}
@@ -92,10 +132,14 @@ func (c *ZaloClient) handleWSReconnect(ctx context.Context) {
 		}
 
 		c.log.Info().Int("attempt", attempt+1).Msg("Attempting WebSocket reconnect")
-		if err := c.connectWS(ctx); err == nil {
+		err := c.connectWS(ctx)
+		if err == nil {
 			c.log.Info().Msg("WebSocket reconnected")
 			go c.wsReadLoop(ctx)
 			return
+		} else if errors.Is(err, ErrSidecarIncompatible) {
+			c.reportIncompatibleSidecar(err)
+			return
 		}
 
 		backoff = min(backoff*2, 30*time.Second)
@@ -103,3 +147,14 @@ func (c *ZaloClient) handleWSReconnect(ctx context.Context) {
 	c.log.Error().Msg("WebSocket reconnect failed after 10 attempts")
 	c.loggedIn = false
 }
+
+// reportIncompatibleSidecar marks the login as unusable until the sidecar is upgraded.
+func (c *ZaloClient) reportIncompatibleSidecar(err error) {
+	c.log.Error().Err(err).Msg("Refusing to use incompatible sidecar")
+	c.loggedIn = false
+	c.userLogin.BridgeState.Send(status.BridgeState{
+		StateEvent: status.StateUnknownError,
+		Error:      "zalo-sidecar-incompatible",
+		Message:    err.Error(),
+	})
+}
@@ -0,0 +1,267 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+// Zalo text styles, as used in the st field of style ranges.
+const (
+	ZaloStyleBold          = "b"
+	ZaloStyleItalic        = "i"
+	ZaloStyleUnderline     = "u"
+	ZaloStyleStrikethrough = "s"
+	ZaloStyleSmall         = "f_13"
+	ZaloStyleBig           = "f_18"
+	zaloStyleColorPrefix   = "c_"
+)
+
+// zaloColorRegex matches the hex colour of a Zalo colour style, which goes into HTML attributes.
+var zaloColorRegex = regexp.MustCompile(`^[0-9a-fA-F]{6}$`)
+
+// Private use characters that delimit span markers while converting outgoing HTML.
+// A span is "<open><idx><end>text<close><idx><end>", where idx indexes the span list.
+const (
+	markerOpen  = '\uE000'
+	markerClose = '\uE001'
+	markerEnd   = '\uE002'
+)
+
+// zaloStyleTags returns the Matrix HTML tags for a Zalo style, or empty strings for
+// styles Matrix can't show. Matrix HTML has no font sizes, so big text is shown as bold.
+func zaloStyleTags(style string) (open, close string) {
+	switch {
+	case style == ZaloStyleBold, style == ZaloStyleBig:
+		return "<strong>", "</strong>"
+	case style == ZaloStyleItalic:
+		return "<em>", "</em>"
+	case style == ZaloStyleUnderline:
+		return "<u>", "</u>"
+	case style == ZaloStyleStrikethrough:
+		return "<del>", "</del>"
+	case strings.HasPrefix(style, zaloStyleColorPrefix):
+		color := strings.TrimPrefix(style, zaloStyleColorPrefix)
+		if !zaloColorRegex.MatchString(color) {
+			return "", ""
+		}
+		return fmt.Sprintf(`<font color="#%s">`, color), "</font>"
+	default:
+		return "", ""
+	}
+}
+
+// convertFormatting turns Zalo style ranges and mentions in a text message into Matrix HTML,
+// with pills and m.mentions for mentioned users.
+func (m *ZaloRemoteMessage) convertFormatting(ctx context.Context, content *event.MessageEventContent) {
+	if len(m.data.Styles) == 0 && len(m.data.Mentions) == 0 {
+		return
+	}
+	text := utf16.Encode([]rune(content.Body))
+	inRange := func(start, length int) bool {
+		return start >= 0 && length > 0 && start+length <= len(text)
+	}
+
+	mentions := slices.Clone(m.data.Mentions)
+	slices.SortFunc(mentions, func(a, b SidecarMention) int { return a.Pos - b.Pos })
+	mentions = slices.DeleteFunc(mentions, func(mention SidecarMention) bool {
+		return !inRange(mention.Pos, mention.Len)
+	})
+	styles := slices.DeleteFunc(slices.Clone(m.data.Styles), func(style SidecarTextStyle) bool {
+		open, _ := zaloStyleTags(style.Style)
+		return open == "" || !inRange(style.Start, style.Len)
+	})
+
+	// Split the text at every style and mention boundary
+	boundaries := []int{0, len(text)}
+	for _, style := range styles {
+		boundaries = append(boundaries, style.Start, style.Start+style.Len)
+	}
+	for _, mention := range mentions {
+		boundaries = append(boundaries, mention.Pos, mention.Pos+mention.Len)
+	}
+	slices.Sort(boundaries)
+	boundaries = slices.Compact(boundaries)
+
+	var html strings.Builder
+	content.Mentions = &event.Mentions{}
+	mentionIdx := 0
+	var prevOpens, prevCloses string
+	for i := 0; i+1 < len(boundaries); i++ {
+		start, end := boundaries[i], boundaries[i+1]
+		var mention *SidecarMention
+		for mentionIdx < len(mentions) && mentions[mentionIdx].Pos < start {
+			mentionIdx++
+		}
+		if mentionIdx < len(mentions) && mentions[mentionIdx].Pos == start {
+			mention = &mentions[mentionIdx]
+			end = mention.Pos + mention.Len
+			for i+1 < len(boundaries) && boundaries[i+1] < end {
+				i++
+			}
+		}
+
+		var opens, closes string
+		for _, style := range styles {
+			if style.Start <= start && style.Start+style.Len >= end {
+				open, closeTag := zaloStyleTags(style.Style)
+				opens += open
+				closes = closeTag + closes
+			}
+		}
+		// Keep the tags open if the previous segment had the same styles
+		if opens != prevOpens {
+			html.WriteString(prevCloses)
+			html.WriteString(opens)
+			prevOpens, prevCloses = opens, closes
+		}
+		segment := event.TextToHTML(string(utf16.Decode(text[start:end])))
+		if mention != nil {
+			html.WriteString(m.client.mentionToHTML(ctx, mention.UID, segment, content.Mentions))
+		} else {
+			html.WriteString(segment)
+		}
+	}
+	html.WriteString(prevCloses)
+
+	content.Format = event.FormatHTML
+	content.FormattedBody = html.String()
+}
+
+// zaloSpan is a style or mention found while converting outgoing HTML.
+type zaloSpan struct {
+	style      string
+	mentionUID string
+	start      int
+}
+
+// convertMatrixFormatting converts a Matrix message into Zalo text with mention and style ranges.
+// Bold, italic, underline, strikethrough and colours become Zalo styles, user pills become
+// "@Name" mentions and @room becomes @All. Lists, code and quotes keep their plain text form.
+// Zalo only supports mentions in groups, so DMs get the names as plain text.
+func (c *ZaloClient) convertMatrixFormatting(ctx context.Context, content *event.MessageEventContent, threadType int) (string, []SidecarMention, []SidecarTextStyle) {
+	isGroup := threadType == ThreadTypeGroup
+	roomMention := isGroup && content.Mentions != nil && content.Mentions.Room
+	if content.Format != event.FormatHTML || content.FormattedBody == "" {
+		text, mentions := convertRoomMention(content.Body, roomMention)
+		return emoteText(content, text, mentions, nil)
+	}
+
+	var spans []*zaloSpan
+	wrap := func(text string, span *zaloSpan) string {
+		spans = append(spans, span)
+		idx := strconv.Itoa(len(spans) - 1)
+		return string(markerOpen) + idx + string(markerEnd) + text + string(markerClose) + idx + string(markerEnd)
+	}
+	styled := func(style string) format.TextConverter {
+		return func(text string, _ format.Context) string {
+			return wrap(text, &zaloSpan{style: style})
+		}
+	}
+	parser := &format.HTMLParser{
+		TabsToSpaces:           4,
+		Newline:                "\n",
+		HorizontalLine:         "\n---\n",
+		BoldConverter:          styled(ZaloStyleBold),
+		ItalicConverter:        styled(ZaloStyleItalic),
+		UnderlineConverter:     styled(ZaloStyleUnderline),
+		StrikethroughConverter: styled(ZaloStyleStrikethrough),
+		ColorConverter: func(text, fg, _ string, _ format.Context) string {
+			if !strings.HasPrefix(fg, "#") || !zaloColorRegex.MatchString(fg[1:]) {
+				return text
+			}
+			return wrap(text, &zaloSpan{style: zaloStyleColorPrefix + strings.ToLower(fg[1:])})
+		},
+		PillConverter: func(displayname, mxid, eventID string, fctx format.Context) string {
+			if !isGroup || !strings.HasPrefix(mxid, "@") || eventID != "" {
+				return format.DefaultPillConverter(displayname, mxid, eventID, fctx)
+			}
+			uid, ok := c.resolveMentionUID(fctx.Ctx, id.UserID(mxid))
+			if !ok {
+				return displayname
+			}
+			return wrap("@"+strings.TrimPrefix(displayname, "@"), &zaloSpan{mentionUID: uid})
+		},
+		TextConverter: func(text string, fctx format.Context) string {
+			if !roomMention || fctx.TagStack.Has("code") || fctx.TagStack.Has("pre") {
+				return text
+			}
+			return roomMentionRegex.ReplaceAllStringFunc(text, func(string) string {
+				return wrap(mentionAllText, &zaloSpan{mentionUID: MentionAllUID})
+			})
+		},
+	}
+	parsed := parser.Parse(content.FormattedBody, format.NewContext(ctx))
+
+	// Strip the markers while tracking UTF-16 offsets
+	var text strings.Builder
+	var mentions []SidecarMention
+	var styles []SidecarTextStyle
+	pos := 0
+	for len(parsed) > 0 {
+		next := strings.IndexFunc(parsed, func(r rune) bool { return r == markerOpen || r == markerClose })
+		if next < 0 {
+			break
+		}
+		text.WriteString(parsed[:next])
+		pos += utf16Len(parsed[:next])
+
+		marker, size := utf8.DecodeRuneInString(parsed[next:])
+		rest := parsed[next+size:]
+		rawIdx, after, ok := strings.Cut(rest, string(markerEnd))
+		idx, err := strconv.Atoi(rawIdx)
+		if !ok || err != nil || idx < 0 || idx >= len(spans) {
+			// Not one of our markers, keep it as text
+			text.WriteRune(marker)
+			pos += utf16.RuneLen(marker)
+			parsed = rest
+			continue
+		}
+		parsed = after
+
+		span := spans[idx]
+		if marker == markerOpen {
+			span.start = pos
+			continue
+		}
+		length := pos - span.start
+		if length <= 0 {
+			continue
+		}
+		if span.mentionUID != "" {
+			mentions = append(mentions, SidecarMention{UID: span.mentionUID, Pos: span.start, Len: length})
+		} else {
+			styles = append(styles, SidecarTextStyle{Start: span.start, Len: length, Style: span.style})
+		}
+	}
+	text.WriteString(parsed)
+	slices.SortFunc(mentions, func(a, b SidecarMention) int { return a.Pos - b.Pos })
+	return emoteText(content, text.String(), mentions, styles)
+}
+
+// emoteText renders m.emote as an italic "* action" line, since Zalo has no emotes.
+func emoteText(content *event.MessageEventContent, text string, mentions []SidecarMention, styles []SidecarTextStyle) (string, []SidecarMention, []SidecarTextStyle) {
+	if content.MsgType != event.MsgEmote {
+		return text, mentions, styles
+	}
+	const prefix = "* "
+	shift := utf16Len(prefix)
+	for i := range mentions {
+		mentions[i].Pos += shift
+	}
+	for i := range styles {
+		styles[i].Start += shift
+	}
+	text = prefix + text
+	styles = append(styles, SidecarTextStyle{Start: 0, Len: utf16Len(text), Style: ZaloStyleItalic})
+	return text, mentions, styles
+}
@@ -0,0 +1,249 @@
+package connector
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestConvertFormatting(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		styles   []SidecarTextStyle
+		mentions []SidecarMention
+		want     string
+		wantRoom bool
+	}{
+		{
+			name: "unformatted",
+			body: "hello",
+		},
+		{
+			name:   "bold",
+			body:   "hello world",
+			styles: []SidecarTextStyle{{Start: 0, Len: 5, Style: ZaloStyleBold}},
+			want:   "<strong>hello</strong> world",
+		},
+		{
+			name: "overlapping styles",
+			body: "abcdef",
+			styles: []SidecarTextStyle{
+				{Start: 0, Len: 4, Style: ZaloStyleBold},
+				{Start: 2, Len: 4, Style: ZaloStyleItalic},
+			},
+			want: "<strong>ab</strong><strong><em>cd</em></strong><em>ef</em>",
+		},
+		{
+			name:   "colour",
+			body:   "red",
+			styles: []SidecarTextStyle{{Start: 0, Len: 3, Style: "c_ff0000"}},
+			want:   `<font color="#ff0000">red</font>`,
+		},
+		{
+			name:   "colour that isn't hex is dropped",
+			body:   "red",
+			styles: []SidecarTextStyle{{Start: 0, Len: 3, Style: `c_"><script>`}, {Start: 0, Len: 3, Style: "c_ff00"}},
+			want:   "red",
+		},
+		{
+			name:   "offsets in UTF-16 code units",
+			body:   "😀 hi",
+			styles: []SidecarTextStyle{{Start: 3, Len: 2, Style: ZaloStyleBold}},
+			want:   "😀 <strong>hi</strong>",
+		},
+		{
+			name:   "out of range and unknown styles are dropped",
+			body:   "hi",
+			styles: []SidecarTextStyle{{Start: 1, Len: 5, Style: ZaloStyleBold}, {Start: 0, Len: 2, Style: "x"}},
+			want:   "hi",
+		},
+		{
+			name:     "mention all",
+			body:     "😀 @All look",
+			mentions: []SidecarMention{{UID: MentionAllUID, Pos: 3, Len: 4}},
+			want:     "😀 @All look",
+			wantRoom: true,
+		},
+		{
+			name:   "HTML is escaped",
+			body:   "<b>",
+			styles: []SidecarTextStyle{{Start: 0, Len: 3, Style: ZaloStyleItalic}},
+			want:   "<em>&lt;b&gt;</em>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ZaloRemoteMessage{
+				data:   &SidecarMessageData{Styles: tt.styles, Mentions: tt.mentions},
+				client: &ZaloClient{},
+			}
+			content := &event.MessageEventContent{MsgType: event.MsgText, Body: tt.body}
+			m.convertFormatting(context.Background(), content)
+			if content.FormattedBody != tt.want {
+				t.Errorf("formatted body = %q, want %q", content.FormattedBody, tt.want)
+			}
+			if tt.want != "" && content.Format != event.FormatHTML {
+				t.Errorf("format = %q, want HTML", content.Format)
+			}
+			if gotRoom := content.Mentions != nil && content.Mentions.Room; gotRoom != tt.wantRoom {
+				t.Errorf("room mention = %v, want %v", gotRoom, tt.wantRoom)
+			}
+		})
+	}
+}
+
+func TestConvertMatrixFormatting(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    *event.MessageEventContent
+		threadType int
+		text       string
+		mentions   []SidecarMention
+		styles     []SidecarTextStyle
+	}{
+		{
+			name:    "plain text",
+			content: &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"},
+			text:    "hello",
+		},
+		{
+			name: "bold and colour",
+			content: &event.MessageEventContent{
+				MsgType:       event.MsgText,
+				Body:          "hi there",
+				Format:        event.FormatHTML,
+				FormattedBody: `<b>hi</b> <font color="#FF0000">there</font>`,
+			},
+			text: "hi there",
+			styles: []SidecarTextStyle{
+				{Start: 0, Len: 2, Style: ZaloStyleBold},
+				{Start: 3, Len: 5, Style: "c_ff0000"},
+			},
+		},
+		{
+			name: "offsets in UTF-16 code units",
+			content: &event.MessageEventContent{
+				MsgType:       event.MsgText,
+				Body:          "😀 hi",
+				Format:        event.FormatHTML,
+				FormattedBody: "😀 <i>hi</i>",
+			},
+			text:   "😀 hi",
+			styles: []SidecarTextStyle{{Start: 3, Len: 2, Style: ZaloStyleItalic}},
+		},
+		{
+			name: "room mention in group",
+			content: &event.MessageEventContent{
+				MsgType:  event.MsgText,
+				Body:     "😀 @room look",
+				Mentions: &event.Mentions{Room: true},
+			},
+			threadType: ThreadTypeGroup,
+			text:       "😀 @All look",
+			mentions:   []SidecarMention{{UID: MentionAllUID, Pos: 3, Len: 4}},
+		},
+		{
+			name: "room mention in DM stays text",
+			content: &event.MessageEventContent{
+				MsgType:  event.MsgText,
+				Body:     "@room look",
+				Mentions: &event.Mentions{Room: true},
+			},
+			threadType: ThreadTypeUser,
+			text:       "@room look",
+		},
+		{
+			name: "formatted room mention",
+			content: &event.MessageEventContent{
+				MsgType:       event.MsgText,
+				Body:          "@room look",
+				Format:        event.FormatHTML,
+				FormattedBody: "@room <b>look</b>",
+				Mentions:      &event.Mentions{Room: true},
+			},
+			threadType: ThreadTypeGroup,
+			text:       "@All look",
+			mentions:   []SidecarMention{{UID: MentionAllUID, Pos: 0, Len: 4}},
+			styles:     []SidecarTextStyle{{Start: 5, Len: 4, Style: ZaloStyleBold}},
+		},
+		{
+			name: "every room mention, but not in words, attributes or code",
+			content: &event.MessageEventContent{
+				MsgType:       event.MsgText,
+				Body:          "@room @roommate a @room",
+				Format:        event.FormatHTML,
+				FormattedBody: `@room @roommate <a href="https://example.com/@room">a</a> <code>@room</code> @room`,
+				Mentions:      &event.Mentions{Room: true},
+			},
+			threadType: ThreadTypeGroup,
+			text:       "@All @roommate a (https://example.com/@room) `@room` @All",
+			mentions: []SidecarMention{
+				{UID: MentionAllUID, Pos: 0, Len: 4},
+				{UID: MentionAllUID, Pos: 53, Len: 4},
+			},
+		},
+		{
+			name: "plain room mentions",
+			content: &event.MessageEventContent{
+				MsgType:  event.MsgText,
+				Body:     "@room, mail a@room.example or @roommate. @room",
+				Mentions: &event.Mentions{Room: true},
+			},
+			threadType: ThreadTypeGroup,
+			text:       "@All, mail a@room.example or @roommate. @All",
+			mentions: []SidecarMention{
+				{UID: MentionAllUID, Pos: 0, Len: 4},
+				{UID: MentionAllUID, Pos: 40, Len: 4},
+			},
+		},
+		{
+			name: "colour that isn't hex is dropped",
+			content: &event.MessageEventContent{
+				MsgType:       event.MsgText,
+				Body:          "x",
+				Format:        event.FormatHTML,
+				FormattedBody: `<font color="#zzzzzz">x</font>`,
+			},
+			text: "x",
+		},
+		{
+			name:    "emote",
+			content: &event.MessageEventContent{MsgType: event.MsgEmote, Body: "waves"},
+			text:    "* waves",
+			styles:  []SidecarTextStyle{{Start: 0, Len: 7, Style: ZaloStyleItalic}},
+		},
+	}
+	c := &ZaloClient{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, mentions, styles := c.convertMatrixFormatting(context.Background(), tt.content, tt.threadType)
+			if text != tt.text {
+				t.Errorf("text = %q, want %q", text, tt.text)
+			}
+			if !slices.Equal(mentions, tt.mentions) {
+				t.Errorf("mentions = %+v, want %+v", mentions, tt.mentions)
+			}
+			if !slices.Equal(styles, tt.styles) {
+				t.Errorf("styles = %+v, want %+v", styles, tt.styles)
+			}
+		})
+	}
+}
+
+func TestUTF16Len(t *testing.T) {
+	tests := map[string]int{
+		"":      0,
+		"abc":   3,
+		"tiếng": 5,
+		"😀":     2,
+		"a😀b":   4,
+	}
+	for s, want := range tests {
+		if got := utf16Len(s); got != want {
+			t.Errorf("utf16Len(%q) = %d, want %d", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package connector
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+)
+
+// Group event types sent by the sidecar.
+const (
+	GroupEventJoin         = "join"
+	GroupEventLeave        = "leave"
+	GroupEventRemoveMember = "remove_member"
+	GroupEventBlockMember  = "block_member"
+	GroupEventUpdate       = "update"
+	GroupEventUpdateAvatar = "update_avatar"
+	GroupEventAddAdmin     = "add_admin"
+	GroupEventRemoveAdmin  = "remove_admin"
+	GroupEventDisband      = "disband"
+)
+
+// Matrix power levels for Zalo group roles.
+const (
+	powerLevelMember  = 0
+	powerLevelAdmin   = 50
+	powerLevelCreator = 95
+)
+
+// SidecarGroupEventData is the JSON shape of a group event from the sidecar WS.
+type SidecarGroupEventData struct {
+	EventType string               `json:"eventType"`
+	GroupID   string               `json:"groupId"`
+	ActorID   string               `json:"actorId"`
+	Members   []SidecarGroupMember `json:"members"`
+	GroupName string               `json:"groupName"`
+	AvatarURL string               `json:"avatarUrl"`
+	Timestamp int64                `json:"timestamp"`
+}
+
+// handleGroupEvent converts a group event from the sidecar WS into a chat info change.
+func (c *ZaloClient) handleGroupEvent(ctx context.Context, data json.RawMessage) {
+	var groupData SidecarGroupEventData
+	if err := json.Unmarshal(data, &groupData); err != nil {
+		c.log.Err(err).Msg("Failed to parse group event")
+		return
+	}
+	if groupData.GroupID == "" {
+		c.log.Warn().Str("event_type", groupData.EventType).Msg("Group event has no group ID")
+		return
+	}
+
+	meta := simplevent.EventMeta{
+		Type:      bridgev2.RemoteEventChatInfoChange,
+		PortalKey: c.makePortalKey(groupData.GroupID, ThreadTypeGroup),
+		Sender:    c.makeEventSender(groupData.ActorID),
+		Timestamp: time.UnixMilli(groupData.Timestamp),
+		LogContext: func(lc zerolog.Context) zerolog.Context {
+			return lc.Str("group_event", groupData.EventType).Str("thread_id", groupData.GroupID)
+		},
+	}
+
+	var change *bridgev2.ChatInfoChange
+	switch groupData.EventType {
+	case GroupEventJoin:
+		change = c.memberChange(ctx, &groupData, event.MembershipJoin, nil)
+		// Being added to a group is how new groups show up
+		meta.CreatePortal = c.includesSelf(groupData.Members)
+	case GroupEventLeave, GroupEventRemoveMember:
+		change = c.memberChange(ctx, &groupData, event.MembershipLeave, nil)
+	case GroupEventBlockMember:
+		change = c.memberChange(ctx, &groupData, event.MembershipBan, nil)
+	case GroupEventAddAdmin:
+		change = c.memberChange(ctx, &groupData, "", ptr.Ptr(powerLevelAdmin))
+	case GroupEventRemoveAdmin:
+		change = c.memberChange(ctx, &groupData, "", ptr.Ptr(powerLevelMember))
+	case GroupEventUpdate:
+		if groupData.GroupName == "" {
+			return
+		}
+		change = &bridgev2.ChatInfoChange{ChatInfo: &bridgev2.ChatInfo{Name: &groupData.GroupName}}
+	case GroupEventUpdateAvatar:
+		avatar := c.makeAvatar(ctx, groupData.AvatarURL)
+		change = &bridgev2.ChatInfoChange{ChatInfo: &bridgev2.ChatInfo{
+			Avatar:       avatar,
+			ExtraUpdates: c.cachePortalAvatar(avatar),
+		}}
+	case GroupEventDisband:
+		meta.Type = bridgev2.RemoteEventChatDelete
+		c.userLogin.QueueRemoteEvent(&simplevent.ChatDelete{EventMeta: meta})
+		return
+	default:
+		c.log.Debug().Str("event_type", groupData.EventType).Msg("Ignoring unsupported group event")
+		return
+	}
+
+	c.userLogin.QueueRemoteEvent(&simplevent.ChatInfoChange{
+		EventMeta:      meta,
+		ChatInfoChange: change,
+	})
+}
+
+// memberChange builds a member list change for the users affected by a group event.
+// Users leaving on their own are their own senders; anyone else was acted on by the actor.
+func (c *ZaloClient) memberChange(ctx context.Context, data *SidecarGroupEventData, membership event.Membership, powerLevel *int) *bridgev2.ChatInfoChange {
+	members := make(bridgev2.ChatMemberMap, len(data.Members))
+	for _, m := range data.Members {
+		member := bridgev2.ChatMember{
+			EventSender: c.makeEventSender(m.UserID),
+			Membership:  membership,
+			PowerLevel:  powerLevel,
+			UserInfo:    c.makeMemberUserInfo(ctx, &m),
+		}
+		if data.ActorID != "" && data.ActorID != m.UserID {
+			member.MemberSender = c.makeEventSender(data.ActorID)
+		}
+		members.Set(member)
+	}
+	return &bridgev2.ChatInfoChange{
+		MemberChanges: &bridgev2.ChatMemberList{MemberMap: members},
+	}
+}
+
+// includesSelf reports whether the logged-in user is one of the given members.
+func (c *ZaloClient) includesSelf(members []SidecarGroupMember) bool {
+	for _, m := range members {
+		if m.UserID == c.meta.UserID {
+			return true
+		}
+	}
+	return false
+}
+
+// makeEventSender creates an EventSender for a Zalo user, marking the logged-in user as from me.
+func (c *ZaloClient) makeEventSender(userID string) bridgev2.EventSender {
+	return bridgev2.EventSender{
+		Sender:   MakeUserID(userID),
+		IsFromMe: userID != "" && userID == c.meta.UserID,
+	}
+}
@@ -3,65 +3,291 @@ package connector
 import (
 	"context"
 	"fmt"
+	"os"
 
+	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/networkid"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
+// StickerIDKey is the event content field holding the Zalo sticker ID of bridged stickers.
+const StickerIDKey = "io.github.niconiconainu.zalo.sticker_id"
+
 // HandleMatrixMessage routes Matrix messages to Zalo by type.
 func (c *ZaloClient) HandleMatrixMessage(ctx context.Context, msg *bridgev2.MatrixMessage) (*bridgev2.MatrixMessageResponse, error) {
-	threadID, threadType := ParsePortalKey(msg.Portal.PortalKey)
+	threadID, threadType, err := ParsePortalKey(msg.Portal.PortalKey)
+	if err != nil {
+		return nil, err
+	}
 
 	switch msg.Content.MsgType {
 	case event.MsgText, event.MsgNotice, event.MsgEmote:
 		return c.handleMatrixText(ctx, msg, threadID, threadType)
 	case event.MsgImage:
+		if !c.hasFeature(FeatureSendImage) {
+			return nil, bridgev2.ErrUnsupportedMessageType
+		}
 		return c.handleMatrixImage(ctx, msg, threadID, threadType)
+	case event.MsgFile, event.MsgVideo, event.MsgAudio:
+		return c.handleMatrixFile(ctx, msg, threadID, threadType)
+	case event.CapMsgSticker:
+		return c.handleMatrixSticker(ctx, msg, threadID, threadType)
 	default:
 		return nil, fmt.Errorf("unsupported message type: %s", msg.Content.MsgType)
 	}
 }
 
 func (c *ZaloClient) handleMatrixText(ctx context.Context, msg *bridgev2.MatrixMessage, threadID string, threadType int) (*bridgev2.MatrixMessageResponse, error) {
-	var quote *string
-	// TODO: handle reply/quote lookup when message DB queries are available
-
-	resp, err := c.sidecar.SendText(ctx, msg.Content.Body, threadID, threadType, quote)
+	text, mentions, styles := c.convertMatrixFormatting(ctx, msg.Content, threadType)
+	resp, err := c.sidecar.SendText(ctx, text, threadID, threadType, makeQuoteRequest(msg.ReplyTo), mentions, styles)
 	if err != nil {
 		return nil, err
 	}
 
 	return &bridgev2.MatrixMessageResponse{
 		DB: &database.Message{
-			ID: networkid.MessageID(resp.MessageID),
+			ID:       networkid.MessageID(resp.MessageID),
+			SenderID: MakeUserID(c.meta.UserID),
+			Metadata: &MessageMetadata{
+				CliMsgID: resp.CliMsgID,
+				MsgType:  "webchat",
+				Content:  text,
+			},
 		},
 	}, nil
 }
 
+// makeQuoteRequest builds the Zalo quote for a Matrix reply from the stored target message.
+func makeQuoteRequest(replyTo *database.Message) *SidecarQuoteRequest {
+	if replyTo == nil {
+		return nil
+	}
+	quote := &SidecarQuoteRequest{
+		MsgID:    string(replyTo.ID),
+		SenderID: string(replyTo.SenderID),
+		TS:       replyTo.Timestamp.UnixMilli(),
+	}
+	if meta, ok := replyTo.Metadata.(*MessageMetadata); ok {
+		quote.CliMsgID = meta.CliMsgID
+		quote.MsgType = meta.MsgType
+		quote.Content = meta.Content
+	}
+	return quote
+}
+
 func (c *ZaloClient) handleMatrixImage(ctx context.Context, msg *bridgev2.MatrixMessage, threadID string, threadType int) (*bridgev2.MatrixMessageResponse, error) {
-	// Download from Matrix mxc:// URI using the bot intent
-	data, err := downloadFromMatrix(ctx, msg.Portal.Bridge.Bot, msg.Content.URL)
+	// Stream from the Matrix mxc:// URI to the sidecar
+	uploadID, info, err := c.uploadMatrixImage(ctx, msg.Content)
 	if err != nil {
-		return nil, fmt.Errorf("download from matrix: %w", err)
+		return nil, err
 	}
 
-	// Save to temp file for sidecar
-	tmpFile, err := saveTempFile(data)
+	req := &SidecarSendImageRequest{
+		UploadID:   uploadID,
+		Width:      info.Width,
+		Height:     info.Height,
+		ThreadID:   threadID,
+		ThreadType: threadType,
+	}
+	// A body that differs from the file name is a caption
+	if msg.Content.GetCaption() != "" {
+		req.Caption, req.Mentions, req.Styles = c.convertMatrixFormatting(ctx, msg.Content, threadType)
+	}
+	resp, err := c.sidecar.SendImage(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("save temp file: %w", err)
+		return nil, err
+	}
+
+	return &bridgev2.MatrixMessageResponse{
+		DB: &database.Message{
+			ID:       networkid.MessageID(resp.MessageID),
+			SenderID: MakeUserID(c.meta.UserID),
+			Metadata: &MessageMetadata{CliMsgID: resp.CliMsgID, MsgType: "chat.photo", Content: req.Caption},
+		},
+	}, nil
+}
+
+// handleMatrixSticker sends stickers that came from Zalo back as native Zalo stickers,
+// and any other sticker as an image.
+func (c *ZaloClient) handleMatrixSticker(ctx context.Context, msg *bridgev2.MatrixMessage, threadID string, threadType int) (*bridgev2.MatrixMessageResponse, error) {
+	stickerID, _ := msg.Event.Content.Raw[StickerIDKey].(string)
+	if stickerID == "" {
+		// Stickers from imported packs are found by their upload
+		mxc := msg.Content.URL
+		if msg.Content.File != nil {
+			mxc = msg.Content.File.URL
+		}
+		stickerID = c.stickerIDForMXC(ctx, mxc)
+	}
+	if stickerID == "" || !c.hasFeature(FeatureSendSticker) {
+		if !c.hasFeature(FeatureSendImage) {
+			return nil, bridgev2.ErrUnsupportedMessageType
+		}
+		return c.handleMatrixImage(ctx, msg, threadID, threadType)
 	}
-	defer cleanupTempFile(tmpFile)
 
-	resp, err := c.sidecar.SendImage(ctx, tmpFile, threadID, threadType)
+	resp, err := c.sidecar.SendSticker(ctx, stickerID, threadID, threadType)
 	if err != nil {
 		return nil, err
 	}
 
 	return &bridgev2.MatrixMessageResponse{
 		DB: &database.Message{
-			ID: networkid.MessageID(resp.MessageID),
+			ID:       networkid.MessageID(resp.MessageID),
+			SenderID: MakeUserID(c.meta.UserID),
+			Metadata: &MessageMetadata{CliMsgID: resp.CliMsgID, MsgType: "chat.sticker"},
 		},
 	}, nil
 }
+
+// handleMatrixFile sends Matrix files, videos and audio to Zalo. Voice messages become Zalo voice
+// messages if they can be transcoded; other audio, and voice without ffmpeg, is sent as a plain file.
+func (c *ZaloClient) handleMatrixFile(ctx context.Context, msg *bridgev2.MatrixMessage, threadID string, threadType int) (*bridgev2.MatrixMessageResponse, error) {
+	content := msg.Content
+	feature, kind, zaloMsgType := FeatureSendFile, mediaKindFile, "share.file"
+	switch {
+	case content.MsgType == event.MsgVideo:
+		feature, kind, zaloMsgType = FeatureSendVideo, mediaKindVideo, "chat.video.msg"
+	case content.MsgType == event.MsgAudio && content.MSC3245Voice != nil && canSendVoice(content):
+		feature, kind, zaloMsgType = FeatureSendVoice, mediaKindVoice, "chat.voice"
+	}
+	if !c.hasFeature(feature) {
+		return nil, bridgev2.ErrUnsupportedMessageType
+	}
+
+	var uploadID string
+	var err error
+	if feature == FeatureSendVoice {
+		uploadID, err = c.uploadMatrixVoice(ctx, content)
+	} else {
+		uploadID, err = c.uploadMatrixMedia(ctx, content, kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *SidecarSendResponse
+	switch feature {
+	case FeatureSendVideo:
+		resp, zaloMsgType, err = c.sendMatrixVideo(ctx, content, uploadID, threadID, threadType)
+	case FeatureSendVoice:
+		resp, err = c.sidecar.SendVoice(ctx, uploadID, threadID, threadType)
+	default:
+		resp, err = c.sidecar.SendFile(ctx, uploadID, threadID, threadType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &bridgev2.MatrixMessageResponse{
+		DB: &database.Message{
+			ID:       networkid.MessageID(resp.MessageID),
+			SenderID: MakeUserID(c.meta.UserID),
+			Metadata: &MessageMetadata{CliMsgID: resp.CliMsgID, MsgType: zaloMsgType},
+		},
+	}, nil
+}
+
+// uploadMatrixMedia streams a Matrix message's media to the sidecar and returns the upload ID,
+// failing with a message status the user can see if it's over the size limit.
+func (c *ZaloClient) uploadMatrixMedia(ctx context.Context, content *event.MessageEventContent, kind mediaKind) (string, error) {
+	// Older sidecars only take file paths, which don't work across containers
+	if !c.hasFeature(FeatureUpload) {
+		return "", bridgev2.ErrUnsupportedMessageType
+	}
+	var expectedSize int64
+	var mimeType string
+	if content.Info != nil {
+		expectedSize = int64(content.Info.Size)
+		mimeType = content.Info.MimeType
+	}
+	uploadID, err := c.uploadMatrixURI(ctx, content.URL, content.File, content.GetFileName(), mimeType, expectedSize, kind)
+	if err != nil {
+		return "", tooLargeStatus(err)
+	}
+	return uploadID, nil
+}
+
+// uploadMatrixImage streams a Matrix image to the sidecar after normalizing its format and size for Zalo,
+// and returns the upload ID and the dimensions of the image that was uploaded, if known.
+func (c *ZaloClient) uploadMatrixImage(ctx context.Context, content *event.MessageEventContent) (uploadID string, info imageInfo, err error) {
+	if !c.hasFeature(FeatureUpload) {
+		return "", info, bridgev2.ErrUnsupportedMessageType
+	}
+	var expectedSize int64
+	if content.Info != nil {
+		expectedSize = int64(content.Info.Size)
+	}
+	maxSize := c.connector.Config.Media.maxSize(mediaKindImage)
+	maxDimension := c.connector.Config.Media.MaxImageDimension
+	err = streamMatrixMedia(ctx, c.connector.Bridge.Bot, content.URL, content.File, expectedSize, mediaKindImage, maxSize, func(file *os.File, size int64) error {
+		img, err := prepareOutgoingImage(ctx, file, size, content.GetFileName(), maxDimension)
+		if err != nil {
+			return err
+		}
+		defer img.Close()
+		if err = checkSize(mediaKindImage, img.Size, maxSize); err != nil {
+			return err
+		}
+		info = img.Image
+		uploadID, err = c.sidecar.Upload(ctx, img.File, img.Size, img.FileName, img.MimeType)
+		return err
+	})
+	if err != nil {
+		return "", info, tooLargeStatus(err)
+	}
+	return uploadID, info, nil
+}
+
+// uploadMatrixURI streams a Matrix mxc:// URI to the sidecar and returns the upload ID.
+func (c *ZaloClient) uploadMatrixURI(
+	ctx context.Context, uri id.ContentURIString, encrypted *event.EncryptedFileInfo,
+	fileName, mimeType string, expectedSize int64, kind mediaKind,
+) (uploadID string, err error) {
+	maxSize := c.connector.Config.Media.maxSize(kind)
+	err = streamMatrixMedia(ctx, c.connector.Bridge.Bot, uri, encrypted, expectedSize, kind, maxSize, func(file *os.File, size int64) error {
+		uploadID, err = c.sidecar.Upload(ctx, file, size, fileName, mimeType)
+		return err
+	})
+	return uploadID, err
+}
+
+// sendMatrixVideo sends an uploaded video along with its Matrix thumbnail. Zalo video messages
+// need a thumbnail, so videos without one, or whose thumbnail fails to upload, are sent as files.
+// It returns the Zalo message type that was sent.
+func (c *ZaloClient) sendMatrixVideo(ctx context.Context, content *event.MessageEventContent, uploadID, threadID string, threadType int) (*SidecarSendResponse, string, error) {
+	req := &SidecarSendVideoRequest{
+		UploadID:   uploadID,
+		ThreadID:   threadID,
+		ThreadType: threadType,
+	}
+	if info := content.Info; info != nil {
+		req.Duration = info.Duration
+		req.Width = info.Width
+		req.Height = info.Height
+		if info.ThumbnailURL != "" || info.ThumbnailFile != nil {
+			var thumbSize int64
+			thumbType := "image/jpeg"
+			if thumbInfo := info.ThumbnailInfo; thumbInfo != nil {
+				thumbSize = int64(thumbInfo.Size)
+				if thumbInfo.MimeType != "" {
+					thumbType = thumbInfo.MimeType
+				}
+			}
+			thumbID, err := c.uploadMatrixURI(ctx, info.ThumbnailURL, info.ThumbnailFile, "thumbnail", thumbType, thumbSize, mediaKindImage)
+			if err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to upload video thumbnail, sending video as file")
+			}
+			req.ThumbnailUploadID = thumbID
+		}
+	}
+	if req.ThumbnailUploadID == "" {
+		resp, err := c.sidecar.SendFile(ctx, uploadID, threadID, threadType)
+		return resp, "share.file", err
+	}
+	resp, err := c.sidecar.SendVideo(ctx, req)
+	return resp, "chat.video.msg", err
+}
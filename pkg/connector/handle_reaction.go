@@ -41,7 +41,7 @@ func (r *ZaloRemoteReaction) GetType() bridgev2.RemoteEventType {
 }
 
 func (r *ZaloRemoteReaction) GetPortalKey() networkid.PortalKey {
-	return MakePortalKey(r.data.ThreadID, r.data.ThreadType)
+	return r.client.makePortalKey(r.data.ThreadID, r.data.ThreadType)
 }
 
 func (r *ZaloRemoteReaction) GetSender() bridgev2.EventSender {
@@ -94,10 +94,16 @@ func (c *ZaloClient) PreHandleMatrixReaction(_ context.Context, msg *bridgev2.Ma
 
 // HandleMatrixReaction sends a reaction to Zalo via the sidecar.
 func (c *ZaloClient) HandleMatrixReaction(ctx context.Context, msg *bridgev2.MatrixReaction) (*database.Reaction, error) {
-	threadID, threadType := ParsePortalKey(msg.Portal.PortalKey)
+	if !c.hasFeature(FeatureReactions) {
+		return nil, bridgev2.ErrReactionsNotSupported
+	}
+	threadID, threadType, err := ParsePortalKey(msg.Portal.PortalKey)
+	if err != nil {
+		return nil, err
+	}
 	targetMsgID := string(msg.TargetMessage.ID)
 
-	err := c.sidecar.SendReaction(ctx, targetMsgID, msg.PreHandleResp.Emoji, threadID, threadType)
+	err = c.sidecar.SendReaction(ctx, targetMsgID, msg.PreHandleResp.Emoji, threadID, threadType)
 	if err != nil {
 		return nil, err
 	}
@@ -107,7 +113,13 @@ func (c *ZaloClient) HandleMatrixReaction(ctx context.Context, msg *bridgev2.Mat
 
 // HandleMatrixReactionRemove removes a reaction from Zalo.
 func (c *ZaloClient) HandleMatrixReactionRemove(ctx context.Context, msg *bridgev2.MatrixReactionRemove) error {
-	threadID, threadType := ParsePortalKey(msg.Portal.PortalKey)
+	if !c.hasFeature(FeatureReactions) {
+		return bridgev2.ErrReactionsNotSupported
+	}
+	threadID, threadType, err := ParsePortalKey(msg.Portal.PortalKey)
+	if err != nil {
+		return err
+	}
 	targetMsgID := string(msg.TargetReaction.MessageID)
 	return c.sidecar.SendReaction(ctx, targetMsgID, "", threadID, threadType)
 }
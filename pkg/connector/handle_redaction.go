@@ -35,7 +35,7 @@ func (u *ZaloRemoteMessageRemove) GetType() bridgev2.RemoteEventType {
 }
 
 func (u *ZaloRemoteMessageRemove) GetPortalKey() networkid.PortalKey {
-	return MakePortalKey(u.data.ThreadID, u.data.ThreadType)
+	return u.client.makePortalKey(u.data.ThreadID, u.data.ThreadType)
 }
 
 func (u *ZaloRemoteMessageRemove) GetSender() bridgev2.EventSender {
@@ -75,7 +75,13 @@ func (c *ZaloClient) handleUndoEvent(_ context.Context, data json.RawMessage) {
 
 // HandleMatrixMessageRemove handles Matrix message deletion -> Zalo undo.
 func (c *ZaloClient) HandleMatrixMessageRemove(ctx context.Context, msg *bridgev2.MatrixMessageRemove) error {
-	threadID, threadType := ParsePortalKey(msg.Portal.PortalKey)
+	if !c.hasFeature(FeatureUndo) {
+		return bridgev2.ErrRedactionsNotSupported
+	}
+	threadID, threadType, err := ParsePortalKey(msg.Portal.PortalKey)
+	if err != nil {
+		return err
+	}
 	targetMsgID := string(msg.TargetMessage.ID)
 	return c.sidecar.UndoMessage(ctx, targetMsgID, threadID, threadType)
 }
@@ -3,9 +3,13 @@ package connector
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
+	"go.mau.fi/util/exmime"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/networkid"
 	"maunium.net/go/mautrix/event"
@@ -13,19 +17,29 @@ import (
 
 // SidecarMessageData is the JSON shape of a message event from the sidecar WS.
 type SidecarMessageData struct {
-	MsgID      string          `json:"msgId"`
-	Content    string          `json:"content"`
-	ThreadID   string          `json:"threadId"`
-	ThreadType int             `json:"threadType"`
-	SenderID   string          `json:"senderId"`
-	IsSelf     bool            `json:"isSelf"`
-	Timestamp  int64           `json:"timestamp"`
-	Quote      json.RawMessage `json:"quote"`
-	MsgType    string          `json:"msgType"`
-	MediaURL   string          `json:"mediaUrl"`
-	Thumb      string          `json:"thumb"`
-	Width      int             `json:"width"`
-	Height     int             `json:"height"`
+	MsgID       string             `json:"msgId"`
+	CliMsgID    string             `json:"cliMsgId"`
+	Content     string             `json:"content"`
+	ThreadID    string             `json:"threadId"`
+	ThreadType  int                `json:"threadType"`
+	SenderID    string             `json:"senderId"`
+	IsSelf      bool               `json:"isSelf"`
+	Timestamp   int64              `json:"timestamp"`
+	Quote       *SidecarQuote      `json:"quote"`
+	Mentions    []SidecarMention   `json:"mentions"`
+	Styles      []SidecarTextStyle `json:"styles"`
+	MsgType     string             `json:"msgType"`
+	ZaloMsgType string             `json:"zaloMsgType"`
+	MediaURL    string             `json:"mediaUrl"`
+	Thumb       string             `json:"thumb"`
+	Width       int                `json:"width"`
+	Height      int                `json:"height"`
+	FileName    string             `json:"fileName"`
+	FileSize    int                `json:"fileSize"`
+	Duration    int                `json:"duration"`
+	StickerID   string             `json:"stickerId"`
+	// The pack (category) of a sticker, for listing the packs used in the login's chats
+	StickerPackID string `json:"stickerPackId"`
 }
 
 // ZaloRemoteMessage implements bridgev2.RemoteMessage and RemoteEventThatMayCreatePortal.
@@ -45,7 +59,7 @@ func (m *ZaloRemoteMessage) GetType() bridgev2.RemoteEventType {
 }
 
 func (m *ZaloRemoteMessage) GetPortalKey() networkid.PortalKey {
-	return MakePortalKey(m.data.ThreadID, m.data.ThreadType)
+	return m.client.makePortalKey(m.data.ThreadID, m.data.ThreadType)
 }
 
 func (m *ZaloRemoteMessage) GetSender() bridgev2.EventSender {
@@ -73,21 +87,84 @@ func (m *ZaloRemoteMessage) ShouldCreatePortal() bool {
 
 // ConvertMessage converts a Zalo message to a Matrix ConvertedMessage.
 func (m *ZaloRemoteMessage) ConvertMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI) (*bridgev2.ConvertedMessage, error) {
+	var converted *bridgev2.ConvertedMessage
+	var err error
 	switch m.data.MsgType {
 	case "image", "gif":
-		return m.convertImageMessage(ctx, portal, intent)
+		converted, err = m.convertImageMessage(ctx, portal, intent)
 	case "sticker":
-		return m.convertStickerMessage(ctx, portal, intent)
+		converted, err = m.convertStickerMessage(ctx, portal, intent)
+	case "voice":
+		converted, err = m.convertVoiceMessage(ctx, portal, intent)
+	case "video", "file":
+		converted, err = m.convertFileMessage(ctx, portal, intent)
 	default:
-		return m.convertTextMessage(ctx, portal)
+		converted, err = m.convertTextMessage(ctx, portal)
 	}
+	var tooLarge *mediaTooLargeError
+	if errors.As(err, &tooLarge) {
+		converted, err = m.convertTooLargeMedia(tooLarge), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m.convertQuote(ctx, portal, converted)
+	for _, part := range converted.Parts {
+		meta := &MessageMetadata{
+			CliMsgID: m.data.CliMsgID,
+			MsgType:  m.data.ZaloMsgType,
+			Content:  m.data.Content,
+		}
+		if m.client.connector.directMedia {
+			meta.MediaURL = m.data.MediaURL
+		}
+		part.DBMetadata = meta
+	}
+	return converted, nil
 }
 
-func (m *ZaloRemoteMessage) convertTextMessage(_ context.Context, _ *bridgev2.Portal) (*bridgev2.ConvertedMessage, error) {
+// convertQuote turns a Zalo quote into a Matrix reply if the quoted message is bridged,
+// or into an inline quote of its text otherwise.
+func (m *ZaloRemoteMessage) convertQuote(ctx context.Context, portal *bridgev2.Portal, converted *bridgev2.ConvertedMessage) {
+	quote := m.data.Quote
+	if quote == nil || quote.MsgID == "" {
+		return
+	}
+	quoteID := networkid.MessageID(quote.MsgID)
+	target, err := portal.Bridge.DB.Message.GetFirstPartByID(ctx, portal.Receiver, quoteID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("quote_msg_id", quote.MsgID).Msg("Failed to look up quoted message")
+	} else if target != nil {
+		converted.ReplyTo = &networkid.MessageOptionalPartID{MessageID: quoteID}
+		return
+	}
+
+	if quote.Content == "" || len(converted.Parts) == 0 {
+		return
+	}
+	content := converted.Parts[0].Content
+	if content.MsgType != event.MsgText {
+		return
+	}
+	quoted := quote.Content
+	if quote.SenderName != "" {
+		quoted = quote.SenderName + ": " + quoted
+	}
+	if content.FormattedBody == "" {
+		content.FormattedBody = event.TextToHTML(content.Body)
+	}
+	content.Format = event.FormatHTML
+	content.FormattedBody = "<blockquote>" + event.TextToHTML(quoted) + "</blockquote>" + content.FormattedBody
+	content.Body = "> " + strings.ReplaceAll(quoted, "\n", "\n> ") + "\n\n" + content.Body
+}
+
+func (m *ZaloRemoteMessage) convertTextMessage(ctx context.Context, _ *bridgev2.Portal) (*bridgev2.ConvertedMessage, error) {
 	content := &event.MessageEventContent{
 		MsgType: event.MsgText,
 		Body:    m.data.Content,
 	}
+	m.convertFormatting(ctx, content)
 
 	return &bridgev2.ConvertedMessage{
 		Parts: []*bridgev2.ConvertedMessagePart{{
@@ -97,33 +174,50 @@ func (m *ZaloRemoteMessage) convertTextMessage(_ context.Context, _ *bridgev2.Po
 	}, nil
 }
 
-func (m *ZaloRemoteMessage) convertImageMessage(ctx context.Context, _ *bridgev2.Portal, intent bridgev2.MatrixAPI) (*bridgev2.ConvertedMessage, error) {
+func (m *ZaloRemoteMessage) convertImageMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI) (*bridgev2.ConvertedMessage, error) {
 	if m.data.MediaURL == "" {
 		// Fallback to text if no media URL
 		return m.convertTextMessage(ctx, nil)
 	}
 
-	imgData, err := downloadFromURL(ctx, m.data.MediaURL)
-	if err != nil {
-		return nil, err
+	name := "image"
+	if m.data.MsgType == "gif" {
+		name = "gif"
 	}
-
-	mxcURI, err := uploadToMatrix(ctx, intent, imgData, "image", detectMIME(imgData))
+	key := mediaURLKey(m.data.MediaURL)
+	media, err := m.convertMedia(ctx, portal, intent, key, name, "", mediaKindImage)
 	if err != nil {
 		return nil, err
 	}
+	if !m.client.connector.directMedia {
+		m.reuploadThumbnail(ctx, portal, intent, key, mediaKindImage, media)
+	}
 
 	content := &event.MessageEventContent{
 		MsgType: event.MsgImage,
-		Body:    "image",
-		URL:     mxcURI,
+		Body:    name,
 		Info: &event.FileInfo{
-			MimeType: detectMIME(imgData),
-			Width:    m.data.Width,
-			Height:   m.data.Height,
-			Size:     len(imgData),
+			Width:  m.data.Width,
+			Height: m.data.Height,
 		},
 	}
+	media.apply(content)
+	if m.data.MsgType == "gif" {
+		if strings.HasPrefix(media.MimeType, "video/") {
+			// GIFs served as video are shown like GIFs: looping, muted and without controls
+			content.MsgType = event.MsgVideo
+			content.Info.MauGIF = true
+		} else if media.Image == (imageInfo{}) {
+			// Direct media isn't probed, but Zalo GIFs are animated
+			content.Info.IsAnimated = true
+		}
+	}
+	if m.data.Content != "" {
+		// Matrix captions are a body that differs from the file name
+		content.FileName = name + exmime.ExtensionFromMimetype(media.MimeType)
+		content.Body = m.data.Content
+		m.convertFormatting(ctx, content)
+	}
 
 	return &bridgev2.ConvertedMessage{
 		Parts: []*bridgev2.ConvertedMessagePart{{
@@ -133,35 +227,150 @@ func (m *ZaloRemoteMessage) convertImageMessage(ctx context.Context, _ *bridgev2
 	}, nil
 }
 
-func (m *ZaloRemoteMessage) convertStickerMessage(ctx context.Context, _ *bridgev2.Portal, intent bridgev2.MatrixAPI) (*bridgev2.ConvertedMessage, error) {
+func (m *ZaloRemoteMessage) convertStickerMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI) (*bridgev2.ConvertedMessage, error) {
 	if m.data.MediaURL == "" {
 		return m.convertTextMessage(ctx, nil)
 	}
 
-	stickerData, err := downloadFromURL(ctx, m.data.MediaURL)
+	// The same sticker is served from different URLs, so prefer its ID as the cache key
+	key := mediaURLKey(m.data.MediaURL)
+	if m.data.StickerID != "" {
+		key = stickerMediaKey(m.data.StickerID)
+	}
+	media, err := m.convertMedia(ctx, portal, intent, key, "sticker", "", mediaKindImage)
 	if err != nil {
 		return nil, err
 	}
+	if m.data.StickerPackID != "" {
+		m.client.rememberStickerPack(ctx, m.data.StickerPackID, time.UnixMilli(m.data.Timestamp))
+	}
 
-	mxcURI, err := uploadToMatrix(ctx, intent, stickerData, "sticker.png", "image/png")
+	content := &event.MessageEventContent{
+		MsgType: event.MsgImage,
+		Body:    "sticker",
+		Info: &event.FileInfo{
+			Width:  m.data.Width,
+			Height: m.data.Height,
+		},
+	}
+	media.apply(content)
+
+	part := &bridgev2.ConvertedMessagePart{
+		Type:    event.EventSticker,
+		Content: content,
+	}
+	if m.data.StickerID != "" {
+		// Lets the sticker be sent back to Zalo as a native sticker
+		part.Extra = map[string]any{StickerIDKey: m.data.StickerID}
+	}
+	return &bridgev2.ConvertedMessage{
+		Parts: []*bridgev2.ConvertedMessagePart{part},
+	}, nil
+}
+
+// convertFileMessage converts Zalo video and file messages into the matching Matrix media message.
+// Voice messages that can't be transcoded are also bridged as plain files.
+func (m *ZaloRemoteMessage) convertFileMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI) (*bridgev2.ConvertedMessage, error) {
+	if m.data.MediaURL == "" {
+		return m.convertTextMessage(ctx, nil)
+	}
+
+	msgType, kind, fileName, mimeType := event.MsgFile, mediaKindFile, m.data.FileName, ""
+	switch m.data.MsgType {
+	case "video":
+		msgType, kind = event.MsgVideo, mediaKindVideo
+		if fileName == "" {
+			fileName = "video.mp4"
+		}
+	case "voice":
+		// Zalo voice messages are AAC in an MP4 container
+		kind, mimeType = mediaKindVoice, "audio/mp4"
+		if fileName == "" {
+			fileName = "voice.m4a"
+		}
+	default:
+		if fileName == "" {
+			fileName = "file"
+		}
+	}
+
+	media, err := m.convertMedia(ctx, portal, intent, "", fileName, mimeType, kind)
 	if err != nil {
 		return nil, err
 	}
+	if msgType == event.MsgVideo && !m.client.connector.directMedia {
+		m.reuploadThumbnail(ctx, portal, intent, mediaURLKey(m.data.MediaURL), kind, media)
+	}
 
 	content := &event.MessageEventContent{
-		MsgType: event.MsgImage,
-		Body:    "sticker",
-		URL:     mxcURI,
+		MsgType:  msgType,
+		Body:     fileName,
+		FileName: fileName,
+		Info: &event.FileInfo{
+			Duration: m.data.Duration,
+		},
+	}
+	media.apply(content)
+	if msgType == event.MsgVideo {
+		content.Info.Width = m.data.Width
+		content.Info.Height = m.data.Height
 	}
 
 	return &bridgev2.ConvertedMessage{
 		Parts: []*bridgev2.ConvertedMessagePart{{
-			Type:    event.EventSticker,
+			Type:    event.EventMessage,
 			Content: content,
 		}},
 	}, nil
 }
 
+// convertMedia bridges the message's media with direct media if it's enabled, or by reuploading it otherwise.
+func (m *ZaloRemoteMessage) convertMedia(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, key, fileName, mimeType string, kind mediaKind) (*uploadedMedia, error) {
+	if m.client.connector.directMedia {
+		return m.directMedia(ctx, portal, fileName, mimeType, kind)
+	}
+	return m.reuploadMedia(ctx, portal, intent, key, fileName, mimeType, kind)
+}
+
+// reuploadMedia streams the message's media from the Zalo CDN into the Matrix media repo,
+// subject to the configured size limit for its kind. If key is set, an earlier upload of
+// the same file is reused from the media cache, and new uploads are added to it.
+func (m *ZaloRemoteMessage) reuploadMedia(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, key, fileName, mimeType string, kind mediaKind) (*uploadedMedia, error) {
+	connector := m.client.connector
+	var encrypted, cacheable bool
+	if key != "" {
+		encrypted, cacheable = roomEncrypted(ctx, connector.Bridge, portal.MXID)
+	}
+	if cacheable {
+		if cached := connector.getCachedMedia(ctx, key, encrypted); cached != nil {
+			return cached, nil
+		}
+	}
+
+	maxSize := connector.Config.Media.maxSize(kind)
+	media, err := connector.Media.streamToMatrix(ctx, intent, portal.MXID, m.data.MediaURL, fileName, mimeType, kind, maxSize)
+	var tooLarge *mediaTooLargeError
+	if err != nil && !errors.As(err, &tooLarge) {
+		return nil, fmt.Errorf("%w: %w", bridgev2.ErrMediaDownloadFailed, err)
+	} else if err == nil && cacheable {
+		connector.cacheMedia(ctx, key, media.cacheEntry())
+	}
+	return media, err
+}
+
+// convertTooLargeMedia replaces media over the size limit with a notice, so the message isn't silently lost.
+func (m *ZaloRemoteMessage) convertTooLargeMedia(tooLarge *mediaTooLargeError) *bridgev2.ConvertedMessage {
+	return &bridgev2.ConvertedMessage{
+		Parts: []*bridgev2.ConvertedMessagePart{{
+			Type: event.EventMessage,
+			Content: &event.MessageEventContent{
+				MsgType: event.MsgNotice,
+				Body:    fmt.Sprintf("Couldn't bridge this message: the %s. Open Zalo to view it.", tooLarge),
+			},
+		}},
+	}
+}
+
 // handleMessageEvent processes an incoming message from sidecar WS.
 func (c *ZaloClient) handleMessageEvent(_ context.Context, data json.RawMessage) {
 	var msgData SidecarMessageData
@@ -174,6 +383,10 @@ func (c *ZaloClient) handleMessageEvent(_ context.Context, data json.RawMessage)
 	if msgData.IsSelf {
 		return
 	}
+	if !c.recentMsgIDs.Add(msgData.MsgID) {
+		c.log.Debug().Str("msg_id", msgData.MsgID).Msg("Dropping duplicate message from replay")
+		return
+	}
 
 	evt := &ZaloRemoteMessage{
 		data:   &msgData,
@@ -0,0 +1,441 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/exmime"
+	"go.mau.fi/util/ffmpeg"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/id"
+)
+
+// imageProbeLen is how many bytes of an image are read to find its dimensions and whether it's
+// animated. GIF loop extensions come after the colour table and APNG control chunks after
+// any metadata chunks, so this is more than content sniffing needs.
+const imageProbeLen = 64 * 1024
+
+// maxDecodedPixels keeps small files with huge dimensions from being decoded in memory.
+const maxDecodedPixels = 50_000_000
+
+// toGIFArgs converts animated images to looping GIFs with a palette generated from the whole animation.
+var toGIFArgs = []string{
+	"-filter_complex", "split[a][b];[a]palettegen=reserve_transparent=1[p];[b][p]paletteuse=alpha_threshold=128",
+	"-loop", "0",
+}
+
+// imageInfo is what could be read from the start of an image file.
+type imageInfo struct {
+	Width    int
+	Height   int
+	Animated bool
+}
+
+// probeImage reads the dimensions and animation flag of a GIF, PNG, WebP or JPEG image from its first bytes.
+// Unknown or truncated images return what could be found.
+func probeImage(head []byte, mimeType string) imageInfo {
+	var info imageInfo
+	switch mimeType {
+	case "image/webp":
+		return probeWebP(head)
+	case "image/png":
+		info.Animated = pngAnimated(head)
+	case "image/gif":
+		// Animated GIFs practically always carry the Netscape looping extension
+		info.Animated = bytes.Contains(head, []byte("NETSCAPE2.0"))
+	}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(head)); err == nil {
+		info.Width, info.Height = cfg.Width, cfg.Height
+	}
+	return info
+}
+
+// probeWebP parses the header of a WebP file, which the standard library can't decode.
+func probeWebP(head []byte) imageInfo {
+	var info imageInfo
+	if len(head) < 30 || string(head[0:4]) != "RIFF" || string(head[8:12]) != "WEBP" {
+		return info
+	}
+	chunk := head[20:]
+	switch string(head[12:16]) {
+	case "VP8X":
+		// Extended format: flags, 3 reserved bytes, then the 24-bit canvas size minus one
+		info.Animated = chunk[0]&0x02 != 0
+		info.Width = int(uint32(chunk[4])|uint32(chunk[5])<<8|uint32(chunk[6])<<16) + 1
+		info.Height = int(uint32(chunk[7])|uint32(chunk[8])<<8|uint32(chunk[9])<<16) + 1
+	case "VP8 ":
+		// Lossy: 3-byte frame tag, start code, then 14-bit dimensions
+		if chunk[3] == 0x9d && chunk[4] == 0x01 && chunk[5] == 0x2a {
+			info.Width = int(binary.LittleEndian.Uint16(chunk[6:8]) & 0x3fff)
+			info.Height = int(binary.LittleEndian.Uint16(chunk[8:10]) & 0x3fff)
+		}
+	case "VP8L":
+		// Lossless: signature byte, then two 14-bit dimensions minus one
+		if chunk[0] == 0x2f {
+			bits := binary.LittleEndian.Uint32(chunk[1:5])
+			info.Width = int(bits&0x3fff) + 1
+			info.Height = int(bits>>14&0x3fff) + 1
+		}
+	}
+	return info
+}
+
+// pngAnimated reports whether a PNG is an APNG, which has an animation control chunk before its image data.
+func pngAnimated(head []byte) bool {
+	const signatureLen = 8
+	for pos := signatureLen; pos+8 <= len(head); {
+		length := int(binary.BigEndian.Uint32(head[pos : pos+4]))
+		switch string(head[pos+4 : pos+8]) {
+		case "acTL":
+			return true
+		case "IDAT":
+			return false
+		}
+		// Chunk length, type, data and CRC
+		pos += 12 + length
+	}
+	return false
+}
+
+// jpegOrientation reads the EXIF orientation of a JPEG from its first bytes: 1 is upright,
+// 2-8 are the mirrorings and rotations needed to display it upright. Anything that can't be
+// read counts as upright.
+func jpegOrientation(head []byte) int {
+	if len(head) < 4 || head[0] != 0xff || head[1] != 0xd8 {
+		return 1
+	}
+	for pos := 2; pos+4 <= len(head) && head[pos] == 0xff; {
+		marker := head[pos+1]
+		length := int(binary.BigEndian.Uint16(head[pos+2 : pos+4]))
+		if marker == 0xda || length < 2 {
+			// Image data starts, metadata segments come before it
+			return 1
+		}
+		segment := head[pos+4 : min(pos+2+length, len(head))]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation finds the orientation tag in the first IFD of TIFF-structured EXIF data.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := range entries {
+		// Tag, type, count and value, which fits in place for a single SHORT
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 {
+			if orientation := int(order.Uint16(tiff[entry+8 : entry+10])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// orientationSwapsAxes reports whether an EXIF orientation turns the image by 90 degrees.
+func orientationSwapsAxes(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// applyOrientation mirrors and rotates an image as its EXIF orientation says, so it's upright.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	w, h := bounds.Dx(), bounds.Dy()
+	dstW, dstH := w, h
+	if orientationSwapsAxes(orientation) {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := range dstH {
+		for x := range dstW {
+			// The source pixel that ends up at (x, y)
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// shouldConvertToGIF reports whether an image should be converted to GIF before uploading.
+// Animated WebP only animates in some Matrix clients and media repo thumbnails of it are
+// static, while GIFs work everywhere. Converting needs an ffmpeg build that decodes animated WebP.
+func shouldConvertToGIF(mimeType string, info imageInfo) bool {
+	return info.Animated && mimeType == "image/webp" && ffmpeg.Supported()
+}
+
+// uploadAsGIF converts an animated image to GIF and uploads it. If the conversion fails,
+// e.g. because ffmpeg can't decode animated WebP, the original file is uploaded instead.
+func uploadAsGIF(
+	ctx context.Context, intent bridgev2.MatrixAPI, roomID id.RoomID, body io.Reader,
+	fileName string, result *uploadedMedia, kind mediaKind, max int64,
+) error {
+	var buf bytes.Buffer
+	if _, err := limitedCopy(&buf, body, kind, max); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	converted, err := ffmpeg.ConvertBytes(ctx, data, ".gif", nil, toGIFArgs, result.MimeType)
+	if err == nil {
+		err = checkSize(kind, int64(len(converted)), max)
+	}
+	if err != nil {
+		zerolog.Ctx(ctx).Debug().Err(err).Msg("Failed to convert animated image to GIF, uploading original")
+	} else {
+		data = converted
+		result.MimeType = "image/gif"
+		fileName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".gif"
+	}
+	result.Size = int64(len(data))
+	result.URL, result.File, err = intent.UploadMedia(ctx, roomID, data, fileName, result.MimeType)
+	if err != nil {
+		return fmt.Errorf("upload to matrix: %w", err)
+	}
+	return nil
+}
+
+// decodeImage decodes an image, refusing ones with more than maxDecodedPixels.
+func decodeImage(r io.ReadSeeker) (image.Image, string, error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("decode image: %w", err)
+	} else if cfg.Width*cfg.Height > maxDecodedPixels {
+		return nil, "", fmt.Errorf("image is too large to decode (%dx%d)", cfg.Width, cfg.Height)
+	} else if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	img, format, err := image.Decode(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("decode image: %w", err)
+	}
+	return img, format, nil
+}
+
+// scaleToFit scales an image down to fit in a size by size square, keeping its aspect ratio.
+// Smaller images are only copied. If background is set, the image is drawn onto it, as JPEG
+// has no transparency.
+func scaleToFit(img image.Image, size int, background color.Color) *image.RGBA {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if size > 0 && (width > size || height > size) {
+		if width >= height {
+			width, height = size, max(1, height*size/width)
+		} else {
+			width, height = max(1, width*size/height), size
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if background != nil {
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	}
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Over, nil)
+	return dst
+}
+
+// outgoingImage is a Matrix image prepared for sending to Zalo.
+type outgoingImage struct {
+	File     *os.File
+	Size     int64
+	FileName string
+	MimeType string
+	Image    imageInfo
+	// temp is set if the image was converted into a temp file, which must be removed.
+	temp bool
+}
+
+func (oi *outgoingImage) Close() {
+	if oi.temp {
+		_ = oi.File.Close()
+		_ = os.Remove(oi.File.Name())
+	}
+}
+
+// prepareOutgoingImage normalizes a downloaded Matrix image into something Zalo shows properly.
+// JPEG, PNG and GIF within maxDimension are sent as they are. Animated images become GIFs if
+// ffmpeg is available, and other formats, as well as larger images and JPEGs with an EXIF
+// orientation, are decoded, turned upright, scaled down to maxDimension and encoded as JPEG, or
+// PNG if they have transparency. Images that can't be decoded are sent as they are, for Zalo to handle.
+func prepareOutgoingImage(ctx context.Context, file *os.File, size int64, fileName string, maxDimension int) (*outgoingImage, error) {
+	head := make([]byte, imageProbeLen)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	} else if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	head = head[:n]
+	mimeType := http.DetectContentType(head[:min(n, sniffLen)])
+	original := &outgoingImage{
+		File:     file,
+		Size:     size,
+		FileName: withExtension(fileName, mimeType),
+		MimeType: mimeType,
+		Image:    probeImage(head, mimeType),
+	}
+	if original.Image.Width == 0 {
+		// The header is past the probed bytes, e.g. after large EXIF data in JPEGs
+		if cfg, _, err := image.DecodeConfig(file); err == nil {
+			original.Image.Width, original.Image.Height = cfg.Width, cfg.Height
+		}
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	orientation := 1
+	if mimeType == "image/jpeg" {
+		orientation = jpegOrientation(head)
+	}
+	if orientationSwapsAxes(orientation) {
+		// Report the size the image is displayed at
+		original.Image.Width, original.Image.Height = original.Image.Height, original.Image.Width
+	}
+	info := original.Image
+	fits := maxDimension <= 0 || (info.Width > 0 && info.Width <= maxDimension && info.Height <= maxDimension)
+
+	switch {
+	case mimeType == "image/gif":
+		// Zalo sends GIFs as animated images, but can't resize them
+		return original, nil
+	case info.Animated:
+		if !ffmpeg.Supported() {
+			return original, nil
+		}
+		output, err := ffmpeg.ConvertPath(ctx, file.Name(), ".gif", nil, toGIFArgs, false)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to convert animated image to GIF, sending original")
+			return original, nil
+		}
+		return openConverted(output, withExtension(stripExtension(fileName), "image/gif"), "image/gif", info)
+	case (mimeType == "image/jpeg" || mimeType == "image/png") && fits && orientation == 1:
+		return original, nil
+	}
+
+	img, _, err := decodeImage(file)
+	if err != nil {
+		zerolog.Ctx(ctx).Debug().Err(err).Str("mime_type", mimeType).Msg("Can't decode image to normalize it, sending original")
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return original, nil
+	}
+	img = applyOrientation(img, orientation)
+	opaque, ok := img.(interface{ Opaque() bool })
+	outType, ext := "image/png", ".png"
+	var background color.Color
+	if ok && opaque.Opaque() {
+		outType, ext, background = "image/jpeg", ".jpg", color.White
+	}
+	scaled := scaleToFit(img, maxDimension, background)
+
+	out, err := os.CreateTemp("", "zalo-image-*"+ext)
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	if outType == "image/jpeg" {
+		err = jpeg.Encode(out, scaled, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(out, scaled)
+	}
+	_ = out.Close()
+	if err != nil {
+		_ = os.Remove(out.Name())
+		return nil, fmt.Errorf("encode image: %w", err)
+	}
+	bounds := scaled.Bounds()
+	return openConverted(out.Name(), stripExtension(fileName)+ext, outType, imageInfo{Width: bounds.Dx(), Height: bounds.Dy()})
+}
+
+// openConverted opens a converted image from a temp file, which is removed when the image is closed.
+func openConverted(path, fileName, mimeType string, info imageInfo) (*outgoingImage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return nil, err
+	}
+	return &outgoingImage{File: file, Size: stat.Size(), FileName: fileName, MimeType: mimeType, Image: info, temp: true}, nil
+}
+
+// withExtension adds the extension of a MIME type to file names without one, as zca-js picks how to send files by it.
+func withExtension(fileName, mimeType string) string {
+	if fileName == "" {
+		fileName = "image"
+	}
+	if filepath.Ext(fileName) != "" {
+		return fileName
+	}
+	return fileName + exmime.ExtensionFromMimetype(mimeType)
+}
+
+// stripExtension removes the extension from a file name, defaulting to "image".
+func stripExtension(fileName string) string {
+	if fileName = strings.TrimSuffix(fileName, filepath.Ext(fileName)); fileName == "" {
+		return "image"
+	}
+	return fileName
+}
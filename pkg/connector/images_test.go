@@ -0,0 +1,255 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// webpHeader builds the first bytes of a WebP file with the given chunk type and payload.
+func webpHeader(chunkType string, payload ...byte) []byte {
+	head := []byte("RIFF\x00\x00\x00\x00WEBP" + chunkType + "\x00\x00\x00\x00")
+	head = append(head, payload...)
+	// probeWebP needs the fixed-size part of the first chunk
+	for len(head) < 30 {
+		head = append(head, 0)
+	}
+	return head
+}
+
+func TestProbeWebP(t *testing.T) {
+	vp8l := make([]byte, 5)
+	vp8l[0] = 0x2f
+	binary.LittleEndian.PutUint32(vp8l[1:], uint32(400-1)|uint32(300-1)<<14)
+
+	tests := []struct {
+		name string
+		head []byte
+		want imageInfo
+	}{
+		{
+			name: "extended animated",
+			// Animation flag, reserved bytes, then 24-bit width and height minus one
+			head: webpHeader("VP8X", 0x02, 0, 0, 0, 0xff, 0x01, 0x00, 0x0f, 0x00, 0x00),
+			want: imageInfo{Width: 512, Height: 16, Animated: true},
+		},
+		{
+			name: "extended static",
+			head: webpHeader("VP8X", 0x10, 0, 0, 0, 0x63, 0x00, 0x00, 0x63, 0x00, 0x00),
+			want: imageInfo{Width: 100, Height: 100},
+		},
+		{
+			name: "lossy",
+			// Frame tag, start code, then 14-bit dimensions with scaling bits set
+			head: webpHeader("VP8 ", 0, 0, 0, 0x9d, 0x01, 0x2a, 0x80, 0x42, 0xe0, 0x41),
+			want: imageInfo{Width: 640, Height: 480},
+		},
+		{
+			name: "lossy without start code",
+			head: webpHeader("VP8 ", 0, 0, 0, 0, 0, 0, 0x80, 0x02, 0xe0, 0x01),
+		},
+		{
+			name: "lossless",
+			head: webpHeader("VP8L", vp8l...),
+			want: imageInfo{Width: 400, Height: 300},
+		},
+		{
+			name: "not WebP",
+			head: bytes.Repeat([]byte{0}, 30),
+		},
+		{
+			name: "truncated",
+			head: []byte("RIFF\x00\x00\x00\x00WEBPVP8X"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := probeWebP(tt.head); got != tt.want {
+				t.Errorf("probeWebP() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// pngWithChunks builds a PNG signature followed by empty chunks of the given types.
+func pngWithChunks(types ...string) []byte {
+	head := []byte("\x89PNG\r\n\x1a\n")
+	for _, chunkType := range types {
+		head = binary.BigEndian.AppendUint32(head, 0)
+		head = append(head, chunkType...)
+		head = append(head, 0, 0, 0, 0)
+	}
+	return head
+}
+
+func TestPNGAnimated(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want bool
+	}{
+		{name: "static", head: pngWithChunks("IHDR", "IDAT", "IEND"), want: false},
+		{name: "animated", head: pngWithChunks("IHDR", "acTL", "IDAT"), want: true},
+		{name: "control chunk after image data", head: pngWithChunks("IHDR", "IDAT", "acTL"), want: false},
+		{name: "control chunk after metadata", head: pngWithChunks("IHDR", "tEXt", "iCCP", "acTL", "IDAT"), want: true},
+		{name: "truncated", head: pngWithChunks("IHDR")[:12], want: false},
+		{name: "signature only", head: pngWithChunks(), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pngAnimated(tt.head); got != tt.want {
+				t.Errorf("pngAnimated() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeImage(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 30, 20), []color.Color{color.Black, color.White})
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, img); err != nil {
+		t.Fatal(err)
+	}
+	var staticGIF, animatedGIF bytes.Buffer
+	if err := gif.Encode(&staticGIF, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := gif.EncodeAll(&animatedGIF, &gif.GIF{Image: []*image.Paletted{img, img}, Delay: []int{10, 10}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		head     []byte
+		mimeType string
+		want     imageInfo
+	}{
+		{name: "PNG", head: pngData.Bytes(), mimeType: "image/png", want: imageInfo{Width: 30, Height: 20}},
+		{name: "static GIF", head: staticGIF.Bytes(), mimeType: "image/gif", want: imageInfo{Width: 30, Height: 20}},
+		{name: "animated GIF", head: animatedGIF.Bytes(), mimeType: "image/gif", want: imageInfo{Width: 30, Height: 20, Animated: true}},
+		{name: "garbage", head: []byte("not an image"), mimeType: "image/jpeg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := probeImage(tt.head, tt.mimeType); got != tt.want {
+				t.Errorf("probeImage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// jpegWithOrientation inserts an EXIF segment with the given orientation after the SOI marker of a JPEG.
+func jpegWithOrientation(jpegData []byte, order binary.AppendByteOrder, orientation uint16) []byte {
+	tiff := []byte("MM\x00*")
+	if order == binary.LittleEndian {
+		tiff = []byte("II*\x00")
+	}
+	tiff = order.AppendUint32(tiff, 8)
+	// One IFD entry: orientation, type SHORT, count 1, value padded to 4 bytes, then no next IFD
+	tiff = order.AppendUint16(tiff, 1)
+	tiff = order.AppendUint16(tiff, 0x0112)
+	tiff = order.AppendUint16(tiff, 3)
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	out := append([]byte{}, jpegData[:2]...)
+	out = append(out, 0xff, 0xe1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, jpegData[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	var plain bytes.Buffer
+	if err := jpeg.Encode(&plain, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		head []byte
+		want int
+	}{
+		{name: "no EXIF", head: plain.Bytes(), want: 1},
+		{name: "big endian", head: jpegWithOrientation(plain.Bytes(), binary.BigEndian, 6), want: 6},
+		{name: "little endian", head: jpegWithOrientation(plain.Bytes(), binary.LittleEndian, 8), want: 8},
+		{name: "invalid value", head: jpegWithOrientation(plain.Bytes(), binary.BigEndian, 9), want: 1},
+		{name: "truncated", head: jpegWithOrientation(plain.Bytes(), binary.BigEndian, 6)[:20], want: 1},
+		{name: "not JPEG", head: pngWithChunks("IHDR"), want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jpegOrientation(tt.head); got != tt.want {
+				t.Errorf("jpegOrientation() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareOutgoingImageOrientation(t *testing.T) {
+	// 40x20, red on the left and blue on the right. Orientation 6 turns it clockwise,
+	// so it's displayed 20x40 with red on top.
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := range 20 {
+		for x := range 40 {
+			if x < 20 {
+				img.Set(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				img.Set(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+	var plain bytes.Buffer
+	if err := jpeg.Encode(&plain, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "rotated.jpg")
+	data := jpegWithOrientation(plain.Bytes(), binary.BigEndian, 6)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	prepared, err := prepareOutgoingImage(context.Background(), file, int64(len(data)), "rotated.jpg", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prepared.Close()
+	if prepared.Image.Width != 20 || prepared.Image.Height != 40 {
+		t.Errorf("reported size = %dx%d, want 20x40", prepared.Image.Width, prepared.Image.Height)
+	}
+	if prepared.MimeType != "image/jpeg" {
+		t.Errorf("MIME type = %s, want image/jpeg", prepared.MimeType)
+	}
+	out, err := jpeg.Decode(prepared.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := out.Bounds().Size(); size != image.Pt(20, 40) {
+		t.Fatalf("encoded size = %v, want 20x40", size)
+	}
+	if converted, err := os.ReadFile(prepared.File.Name()); err != nil {
+		t.Fatal(err)
+	} else if jpegOrientation(converted) != 1 {
+		t.Error("converted image still has an EXIF orientation")
+	}
+	if r, _, b, _ := out.At(10, 5).RGBA(); r < b {
+		t.Errorf("top of the image isn't red")
+	}
+	if r, _, b, _ := out.At(10, 35).RGBA(); b < r {
+		t.Errorf("bottom of the image isn't blue")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 
+	"go.mau.fi/util/random"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/networkid"
@@ -16,13 +17,25 @@ import (
 type ZaloLogin struct {
 	connector *ZaloConnector
 	user      *bridgev2.User
+	// sessionID is a temporary sidecar session; the sidecar re-keys it to the Zalo UID on success.
+	sessionID string
 }
 
 var _ bridgev2.LoginProcessDisplayAndWait = (*ZaloLogin)(nil)
 
+// newRequest creates a sidecar request scoped to this login's temporary session.
+func (l *ZaloLogin) newRequest(ctx context.Context, method, path string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, l.connector.Config.SidecarURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(SidecarSessionHeader, l.sessionID)
+	return req, nil
+}
+
 func (l *ZaloLogin) Start(ctx context.Context) (*bridgev2.LoginStep, error) {
-	sidecarURL := l.connector.Config.SidecarURL
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sidecarURL+"/login/qr", nil)
+	l.sessionID = "login-" + random.String(16)
+	req, err := l.newRequest(ctx, http.MethodPost, "/login/qr")
 	if err != nil {
 		return nil, fmt.Errorf("create QR request: %w", err)
 	}
@@ -60,8 +73,7 @@ func (l *ZaloLogin) Start(ctx context.Context) (*bridgev2.LoginStep, error) {
 }
 
 func (l *ZaloLogin) Wait(ctx context.Context) (*bridgev2.LoginStep, error) {
-	sidecarURL := l.connector.Config.SidecarURL
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sidecarURL+"/login/wait", nil)
+	req, err := l.newRequest(ctx, http.MethodGet, "/login/wait")
 	if err != nil {
 		return nil, fmt.Errorf("create wait request: %w", err)
 	}
@@ -105,7 +117,7 @@ func (l *ZaloLogin) finishLogin(ctx context.Context, session *SidecarLoginRespon
 		return nil, fmt.Errorf("save user login: %w", err)
 	}
 
-	sidecar := NewSidecarClient(l.connector.Config.SidecarURL)
+	sidecar := NewSidecarClient(l.connector.Config.SidecarURL, string(loginID))
 	ul.Client = &ZaloClient{
 		connector: l.connector,
 		userLogin: ul,
@@ -125,8 +137,14 @@ func (l *ZaloLogin) finishLogin(ctx context.Context, session *SidecarLoginRespon
 }
 
 func (l *ZaloLogin) Cancel() {
-	sidecarURL := l.connector.Config.SidecarURL
-	_, _ = http.Post(sidecarURL+"/logout", "application/json", nil)
+	req, err := l.newRequest(context.Background(), http.MethodPost, "/logout")
+	if err != nil {
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		_ = resp.Body.Close()
+	}
 }
 
 // MakeUserLoginIDFromMeta creates a UserLoginID from metadata.
@@ -1,80 +1,255 @@
 package connector
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
 
+	"go.mau.fi/util/exmime"
 	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
-// downloadFromURL downloads a file from a URL to bytes.
-func downloadFromURL(ctx context.Context, url string) ([]byte, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("create download request: %w", err)
+// Media kinds with separate size limits.
+type mediaKind string
+
+const (
+	mediaKindImage mediaKind = "image"
+	mediaKindVideo mediaKind = "video"
+	mediaKindVoice mediaKind = "voice"
+	mediaKindFile  mediaKind = "file"
+)
+
+// maxAvatarSize caps avatar downloads, which are buffered in memory.
+const maxAvatarSize = 10 * 1024 * 1024
+
+// sniffLen is how many bytes http.DetectContentType looks at.
+const sniffLen = 512
+
+// mediaTooLargeError is returned when a file exceeds the configured size limit for its kind.
+type mediaTooLargeError struct {
+	kind mediaKind
+	size int64
+	max  int64
+}
+
+func (e *mediaTooLargeError) Error() string {
+	if e.size < 0 {
+		return fmt.Sprintf("%s is larger than the %s limit", e.kind, formatSize(e.max))
 	}
-	resp, err := http.DefaultClient.Do(req)
+	return fmt.Sprintf("%s is too large (%s, the limit is %s)", e.kind, formatSize(e.size), formatSize(e.max))
+}
+
+// formatSize formats a byte count in megabytes for notices.
+func formatSize(size int64) string {
+	return fmt.Sprintf("%.1f MB", float64(size)/1024/1024)
+}
+
+// maxSize returns the size limit for a kind of media in bytes, or 0 if it's unlimited.
+func (mc *MediaConfig) maxSize(kind mediaKind) int64 {
+	var mb int
+	switch kind {
+	case mediaKindImage:
+		mb = mc.MaxImageSize
+	case mediaKindVideo:
+		mb = mc.MaxVideoSize
+	case mediaKindVoice:
+		mb = mc.MaxVoiceSize
+	default:
+		mb = mc.MaxFileSize
+	}
+	return int64(mb) * 1024 * 1024
+}
+
+// checkSize returns a mediaTooLargeError if size exceeds max. A max of 0 means no limit.
+func checkSize(kind mediaKind, size, max int64) error {
+	if max > 0 && size > max {
+		return &mediaTooLargeError{kind: kind, size: size, max: max}
+	}
+	return nil
+}
+
+// limitedCopy copies src to dst, failing with a mediaTooLargeError once more than max bytes were read.
+func limitedCopy(dst io.Writer, src io.Reader, kind mediaKind, max int64) (int64, error) {
+	if max <= 0 {
+		return io.Copy(dst, src)
+	}
+	n, err := io.Copy(dst, io.LimitReader(src, max+1))
 	if err != nil {
-		return nil, fmt.Errorf("download file: %w", err)
+		return n, err
 	}
-	defer resp.Body.Close()
+	if n > max {
+		return n, &mediaTooLargeError{kind: kind, size: -1, max: max}
+	}
+	return n, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("download failed with status %d", resp.StatusCode)
+// download downloads a small file, such as an avatar, from a URL to bytes.
+func (f *mediaFetcher) download(ctx context.Context, url string, max int64) ([]byte, error) {
+	resp, err := f.open(ctx, url, mediaKindImage, max)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	data, err := io.ReadAll(resp.Body)
+	data, err := io.ReadAll(io.LimitReader(resp.Body, max+1))
 	if err != nil {
 		return nil, fmt.Errorf("read download body: %w", err)
+	} else if int64(len(data)) > max {
+		return nil, &mediaTooLargeError{kind: mediaKindImage, size: -1, max: max}
 	}
 	return data, nil
 }
 
-// uploadToMatrix uploads data to the Matrix media repo.
-func uploadToMatrix(ctx context.Context, intent bridgev2.MatrixAPI, data []byte, filename, mimetype string) (id.ContentURIString, error) {
-	uri, _, err := intent.UploadMedia(ctx, "", data, filename, mimetype)
-	if err != nil {
-		return "", fmt.Errorf("upload to matrix: %w", err)
+// uploadedMedia describes a file streamed into the Matrix media repo.
+type uploadedMedia struct {
+	URL      id.ContentURIString
+	File     *event.EncryptedFileInfo
+	MimeType string
+	Size     int64
+	Image    imageInfo
+	// Blurhash is only set for thumbnails, the blurhash of an image is that of its thumbnail.
+	Blurhash  string
+	Thumbnail *uploadedMedia
+}
+
+// apply sets the media URL, encryption info, MIME type and size on a message, as well as
+// the dimensions, animation flag and thumbnail of images. Dimensions read from the file
+// replace the ones Zalo reported, which may be of a differently sized variant.
+func (um *uploadedMedia) apply(content *event.MessageEventContent) {
+	content.URL = um.URL
+	content.File = um.File
+	if content.Info == nil {
+		content.Info = &event.FileInfo{}
+	}
+	content.Info.MimeType = um.MimeType
+	content.Info.Size = int(um.Size)
+	if um.Image.Width > 0 && um.Image.Height > 0 {
+		content.Info.Width = um.Image.Width
+		content.Info.Height = um.Image.Height
+	}
+	content.Info.IsAnimated = um.Image.Animated
+	if thumb := um.Thumbnail; thumb != nil {
+		content.Info.ThumbnailURL = thumb.URL
+		content.Info.ThumbnailFile = thumb.File
+		content.Info.ThumbnailInfo = &event.FileInfo{
+			MimeType: thumb.MimeType,
+			Size:     int(thumb.Size),
+			Width:    thumb.Image.Width,
+			Height:   thumb.Image.Height,
+		}
+		content.Info.Blurhash = thumb.Blurhash
+		content.Info.AnoaBlurhash = thumb.Blurhash
 	}
-	return uri, nil
 }
 
-// downloadFromMatrix downloads media from a Matrix mxc:// URI via the intent.
-func downloadFromMatrix(ctx context.Context, intent bridgev2.MatrixAPI, mxcURI id.ContentURIString) ([]byte, error) {
-	data, err := intent.DownloadMedia(ctx, mxcURI, nil)
+// streamToMatrix streams a file from a URL into the Matrix media repo through a temp file,
+// so large media never sits in memory. If mimeType is empty, it's guessed from the file name
+// or the content, and an extension for it is added to file names without one. Images are
+// probed for their dimensions, and animated WebP is converted to GIF if possible.
+func (f *mediaFetcher) streamToMatrix(ctx context.Context, intent bridgev2.MatrixAPI, roomID id.RoomID, url, fileName, mimeType string, kind mediaKind, max int64) (*uploadedMedia, error) {
+	resp, err := f.open(ctx, url, kind, max)
 	if err != nil {
-		return nil, fmt.Errorf("download from matrix: %w", err)
+		return nil, err
 	}
-	return data, nil
-}
+	defer resp.Body.Close()
 
-// saveTempFile writes data to a temporary file and returns the path.
-func saveTempFile(data []byte) (string, error) {
-	tmp, err := os.CreateTemp("", "mautrix-zalo-*")
+	probeLen := sniffLen
+	if kind == mediaKindImage {
+		probeLen = imageProbeLen
+	}
+	body := bufio.NewReaderSize(resp.Body, probeLen)
+	head, _ := body.Peek(probeLen)
+	result := &uploadedMedia{MimeType: mimeType}
+	if result.MimeType == "" {
+		result.MimeType = mimeForFile(head[:min(len(head), sniffLen)], fileName)
+	}
+	if filepath.Ext(fileName) == "" {
+		fileName += exmime.ExtensionFromMimetype(result.MimeType)
+	}
+	if kind == mediaKindImage {
+		result.Image = probeImage(head, result.MimeType)
+	}
+	if shouldConvertToGIF(result.MimeType, result.Image) {
+		if err = uploadAsGIF(ctx, intent, roomID, body, fileName, result, kind, max); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	result.URL, result.File, err = intent.UploadMediaStream(ctx, roomID, resp.ContentLength, false, func(file io.Writer) (*bridgev2.FileStreamResult, error) {
+		size, err := limitedCopy(file, body, kind, max)
+		if err != nil {
+			return nil, err
+		}
+		result.Size = size
+		return &bridgev2.FileStreamResult{FileName: fileName, MimeType: result.MimeType}, nil
+	})
 	if err != nil {
-		return "", fmt.Errorf("create temp file: %w", err)
+		var tooLarge *mediaTooLargeError
+		if errors.As(err, &tooLarge) {
+			return nil, tooLarge
+		}
+		return nil, fmt.Errorf("upload to matrix: %w", err)
 	}
-	if _, err := tmp.Write(data); err != nil {
-		tmp.Close()
-		os.Remove(tmp.Name())
-		return "", fmt.Errorf("write temp file: %w", err)
+	return result, nil
+}
+
+// streamMatrixMedia downloads Matrix media into a temp file and passes it to fn, positioned at the start.
+// Files over max are rejected with a mediaTooLargeError, before downloading if expectedSize says so.
+func streamMatrixMedia(
+	ctx context.Context, intent bridgev2.MatrixAPI, uri id.ContentURIString, encrypted *event.EncryptedFileInfo,
+	expectedSize int64, kind mediaKind, max int64, fn func(file *os.File, size int64) error,
+) error {
+	if err := checkSize(kind, expectedSize, max); err != nil {
+		return err
 	}
-	tmp.Close()
-	return tmp.Name(), nil
+	err := intent.DownloadMediaToFile(ctx, uri, encrypted, false, func(file *os.File) error {
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if err = checkSize(kind, info.Size(), max); err != nil {
+			return err
+		}
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return fn(file, info.Size())
+	})
+	var tooLarge *mediaTooLargeError
+	if err != nil && !errors.As(err, &tooLarge) {
+		return fmt.Errorf("transfer matrix media: %w", err)
+	}
+	return err
 }
 
-// cleanupTempFile removes a temporary file.
-func cleanupTempFile(path string) {
-	if path != "" {
-		os.Remove(path)
+// mimeForFile picks the MIME type of a downloaded file, preferring its extension
+// since content sniffing can't tell most document and audio formats apart.
+func mimeForFile(head []byte, fileName string) string {
+	if mimeType := mime.TypeByExtension(filepath.Ext(fileName)); mimeType != "" {
+		return mimeType
 	}
+	return http.DetectContentType(head)
 }
 
-// detectMIME detects the MIME type from file data.
-func detectMIME(data []byte) string {
-	return http.DetectContentType(data)
+// tooLargeStatus turns a mediaTooLargeError into a message status that tells the Matrix user
+// why their file wasn't sent. Other errors are returned as-is.
+func tooLargeStatus(err error) error {
+	var tooLarge *mediaTooLargeError
+	if !errors.As(err, &tooLarge) {
+		return err
+	}
+	return bridgev2.WrapErrorInStatus(tooLarge).
+		WithErrorAsMessage().
+		WithIsCertain(true).
+		WithSendNotice(true).
+		WithErrorReason(event.MessageStatusUnsupported)
 }
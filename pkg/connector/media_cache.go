@@ -0,0 +1,93 @@
+package connector
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/matrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/niconiconainu/mautrix-zalo/pkg/connector/zalodb"
+)
+
+// mediaURLKey identifies a file on the Zalo CDN for the media cache. The query string only
+// carries signatures and expiry times, so it's dropped, but the host is kept: size-specific
+// hosts (e.g. s120-ava-talk.zadn.vn and s240-ava-talk.zadn.vn) serve different files under
+// the same path, and unrelated CDNs can't be assumed to use distinct paths.
+func mediaURLKey(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || u.Path == "" || u.Path == "/" {
+		return rawURL
+	}
+	return strings.ToLower(u.Host) + u.Path
+}
+
+// stickerMediaKey identifies a Zalo sticker for the media cache.
+func stickerMediaKey(stickerID string) string {
+	return "sticker:" + stickerID
+}
+
+// thumbnailMediaKey identifies the thumbnail of a file for the media cache.
+func thumbnailMediaKey(key string) string {
+	return "thumb:" + key
+}
+
+// roomEncrypted reports whether media sent to a room gets encrypted. ok is false if that can't
+// be determined, in which case the media cache isn't used for the room.
+func roomEncrypted(ctx context.Context, bridge *bridgev2.Bridge, roomID id.RoomID) (encrypted, ok bool) {
+	mc, isAS := bridge.Matrix.(*matrix.Connector)
+	if !isAS || mc.StateStore == nil || roomID == "" {
+		return false, false
+	}
+	encrypted, err := mc.StateStore.IsEncrypted(ctx, roomID)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to check if room is encrypted for media cache")
+		return false, false
+	}
+	return encrypted, true
+}
+
+// getCachedMedia returns an earlier upload of a file that can be reused, or nil if there is none.
+func (z *ZaloConnector) getCachedMedia(ctx context.Context, key string, encrypted bool) *uploadedMedia {
+	cached, err := z.DB.Media.Get(ctx, key, encrypted)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("media_key", key).Msg("Failed to get cached media")
+		return nil
+	} else if cached == nil {
+		return nil
+	}
+	return &uploadedMedia{
+		URL:      cached.MXC,
+		File:     cached.File,
+		MimeType: cached.MimeType,
+		Size:     cached.Size,
+		Image:    imageInfo{Width: cached.Width, Height: cached.Height, Animated: cached.Animated},
+		Blurhash: cached.Blurhash,
+	}
+}
+
+// cacheEntry describes an upload for the media cache.
+func (um *uploadedMedia) cacheEntry() *zalodb.Media {
+	return &zalodb.Media{
+		Encrypted: um.File != nil,
+		MXC:       um.URL,
+		File:      um.File,
+		MimeType:  um.MimeType,
+		Size:      um.Size,
+		Width:     um.Image.Width,
+		Height:    um.Image.Height,
+		Animated:  um.Image.Animated,
+		Blurhash:  um.Blurhash,
+	}
+}
+
+// cacheMedia remembers an upload so the same file isn't uploaded again.
+func (z *ZaloConnector) cacheMedia(ctx context.Context, key string, media *zalodb.Media) {
+	media.Key = key
+	if err := z.DB.Media.Put(ctx, media); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("media_key", key).Msg("Failed to cache uploaded media")
+	}
+}
@@ -0,0 +1,20 @@
+package connector
+
+import "testing"
+
+func TestMediaURLKey(t *testing.T) {
+	tests := map[string]string{
+		"https://s120-ava-talk.zadn.vn/a/b/c.jpg":          "s120-ava-talk.zadn.vn/a/b/c.jpg",
+		"https://s240-ava-talk.zadn.vn/a/b/c.jpg":          "s240-ava-talk.zadn.vn/a/b/c.jpg",
+		"https://f21-zpc.zdn.vn/jpg/1/x.jpg?exp=1&sig=abc": "f21-zpc.zdn.vn/jpg/1/x.jpg",
+		"https://F21-ZPC.zdn.vn/jpg/1/x.jpg":               "f21-zpc.zdn.vn/jpg/1/x.jpg",
+		"https://example.com/":                             "https://example.com/",
+		"not a url":                                        "not a url",
+		"/relative/path.jpg":                               "/relative/path.jpg",
+	}
+	for rawURL, want := range tests {
+		if got := mediaURLKey(rawURL); got != want {
+			t.Errorf("mediaURLKey(%q) = %q, want %q", rawURL, got, want)
+		}
+	}
+}
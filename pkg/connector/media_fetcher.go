@@ -0,0 +1,166 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultMediaHosts are the domains Zalo serves media from, used when media.allowed_hosts is empty.
+var DefaultMediaHosts = []string{"zdn.vn", "zadn.vn", "zalo.me", "zaloapp.com", "dlfl.vn"}
+
+const (
+	defaultDownloadTimeout = 5 * time.Minute
+	mediaDialTimeout       = 10 * time.Second
+	mediaHeaderTimeout     = 30 * time.Second
+	maxMediaRedirects      = 3
+)
+
+// ErrUntrustedMediaURL is returned for media URLs outside the allowlist or pointing at internal addresses.
+var ErrUntrustedMediaURL = errors.New("untrusted media URL")
+
+// errMediaGone is returned when the CDN no longer serves a file, usually because the link expired.
+var errMediaGone = errors.New("media link expired")
+
+// mediaFetcher downloads media referenced by sidecar events. URLs come from Zalo messages,
+// so it only fetches from allowlisted hosts on public addresses, follows a few redirects at most
+// and gives up on slow transfers.
+type mediaFetcher struct {
+	client       *http.Client
+	allowedHosts []string
+}
+
+func newMediaFetcher(cfg *MediaConfig) *mediaFetcher {
+	f := &mediaFetcher{allowedHosts: DefaultMediaHosts}
+	if len(cfg.AllowedHosts) > 0 {
+		f.allowedHosts = cfg.AllowedHosts
+	}
+	timeout := defaultDownloadTimeout
+	if cfg.DownloadTimeout > 0 {
+		timeout = time.Duration(cfg.DownloadTimeout) * time.Second
+	}
+
+	dialer := &net.Dialer{
+		Timeout: mediaDialTimeout,
+		// Checked on the resolved address, so DNS can't be used to reach internal hosts
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip, err := netip.ParseAddr(host); err != nil || !isPublicIP(ip) {
+				return fmt.Errorf("%w: %s is not a public address", ErrUntrustedMediaURL, host)
+			}
+			return nil
+		},
+	}
+	f.client = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// No proxy: the address checks must apply to the media host itself
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   mediaDialTimeout,
+			ResponseHeaderTimeout: mediaHeaderTimeout,
+			MaxIdleConnsPerHost:   4,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxMediaRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxMediaRedirects)
+			}
+			return f.checkURL(req.URL)
+		},
+	}
+	return f
+}
+
+// nonPublicPrefixes are the special-purpose ranges that IsGlobalUnicast and IsPrivate don't
+// exclude, from the IANA special-purpose address registries. The IPv6 ones that embed IPv4
+// addresses (NAT64, 6to4 and Teredo) could reach internal IPv4 hosts through a gateway.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("3fff::/20"),
+}
+
+// isPublicIP reports whether ip is a globally routable unicast address.
+func isPublicIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkURL verifies that a URL uses HTTP(S) and points at an allowed host.
+func (f *mediaFetcher) checkURL(u *url.URL) error {
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("%w: unsupported scheme %q", ErrUntrustedMediaURL, u.Scheme)
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	for _, allowed := range f.allowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: host %q is not allowed", ErrUntrustedMediaURL, host)
+}
+
+// open starts downloading a file, rejecting it early if the server reports a size over max.
+func (f *mediaFetcher) open(ctx context.Context, rawURL string, kind mediaKind, max int64) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUntrustedMediaURL, err)
+	}
+	if err = f.checkURL(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create download request: %w", err)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("download file: %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w (status %d)", errMediaGone, resp.StatusCode)
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("download failed with status %d", resp.StatusCode)
+	}
+	if err = checkSize(kind, resp.ContentLength, max); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
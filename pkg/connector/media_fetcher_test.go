@@ -0,0 +1,50 @@
+package connector
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := map[string]bool{
+		"1.1.1.1":              true,
+		"203.113.1.1":          true,
+		"2606:4700::1111":      true,
+		"10.0.0.1":             false,
+		"172.16.5.4":           false,
+		"192.168.1.1":          false,
+		"127.0.0.1":            false,
+		"169.254.169.254":      false,
+		"0.0.0.0":              false,
+		"255.255.255.255":      false,
+		"224.0.0.1":            false,
+		"::1":                  false,
+		"::":                   false,
+		"fe80::1":              false,
+		"fc00::1":              false,
+		"ff02::1":              false,
+		"::ffff:10.0.0.1":      false,
+		"::ffff:93.184.216.34": true,
+		"100.64.0.1":           false,
+		"100.127.255.254":      false,
+		"100.128.0.1":          true,
+		"192.0.0.8":            false,
+		"192.0.2.1":            false,
+		"198.18.0.1":           false,
+		"198.19.255.255":       false,
+		"198.20.0.1":           true,
+		"198.51.100.7":         false,
+		"203.0.113.9":          false,
+		"240.0.0.1":            false,
+		"64:ff9b::a00:1":       false,
+		"2001:db8::1":          false,
+		"2001::1":              false,
+		"2002:a00:1::1":        false,
+		"2001:4860::8888":      true,
+	}
+	for addr, want := range tests {
+		if got := isPublicIP(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MentionAllUID is the user ID Zalo uses for @All mentions in groups.
+const MentionAllUID = "-1"
+
+// mentionAllText is the text Zalo shows for an @All mention.
+const mentionAllText = "@All"
+
+// mentionToHTML renders a Zalo mention as a Matrix pill and records it in m.mentions.
+func (c *ZaloClient) mentionToHTML(ctx context.Context, uid, name string, mentions *event.Mentions) string {
+	if uid == MentionAllUID {
+		mentions.Room = true
+		return name
+	}
+	mxid := c.resolveMentionMXID(ctx, uid)
+	if mxid == "" {
+		return name
+	}
+	mentions.Add(mxid)
+	return fmt.Sprintf(`<a href="%s">%s</a>`, mxid.URI().MatrixToURL(), name)
+}
+
+// resolveMentionMXID finds the Matrix user for a mentioned Zalo user:
+// the bridge user if they're logged in here, or their ghost otherwise.
+func (c *ZaloClient) resolveMentionMXID(ctx context.Context, uid string) id.UserID {
+	if login := c.connector.Bridge.GetCachedUserLoginByID(networkid.UserLoginID(uid)); login != nil {
+		return login.UserMXID
+	}
+	ghost, err := c.connector.Bridge.GetGhostByID(ctx, MakeUserID(uid))
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("mentioned_uid", uid).Msg("Failed to get ghost for mention")
+		return ""
+	}
+	return ghost.Intent.GetMXID()
+}
+
+// resolveMentionUID finds the Zalo user ID for a mentioned Matrix user.
+func (c *ZaloClient) resolveMentionUID(ctx context.Context, mxid id.UserID) (string, bool) {
+	if ghostID, ok := c.connector.Bridge.Matrix.ParseGhostMXID(mxid); ok {
+		return string(ghostID), true
+	}
+	user, err := c.connector.Bridge.GetExistingUserByMXID(ctx, mxid)
+	if err != nil || user == nil {
+		return "", false
+	}
+	if login := user.GetDefaultLogin(); login != nil {
+		return string(login.ID), true
+	}
+	return "", false
+}
+
+// roomMentionRegex finds @room as a word of its own, so e.g. @roommate and user@room.example are left alone.
+var roomMentionRegex = regexp.MustCompile(`\B@room\b`)
+
+// convertRoomMention replaces each @room in a plain text message with an @All mention.
+func convertRoomMention(text string, roomMention bool) (string, []SidecarMention) {
+	if !roomMention {
+		return text, nil
+	}
+	var out strings.Builder
+	var mentions []SidecarMention
+	last := 0
+	for _, loc := range roomMentionRegex.FindAllStringIndex(text, -1) {
+		out.WriteString(text[last:loc[0]])
+		mentions = append(mentions, SidecarMention{UID: MentionAllUID, Pos: utf16Len(out.String()), Len: utf16Len(mentionAllText)})
+		out.WriteString(mentionAllText)
+		last = loc[1]
+	}
+	out.WriteString(text[last:])
+	return out.String(), mentions
+}
+
+// utf16Len returns the length of a string in UTF-16 code units,
+// which is what Zalo mention and style ranges are measured in.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
@@ -0,0 +1,117 @@
+package connector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SidecarProtocolVersion is the sidecar protocol this bridge speaks.
+// It must match PROTOCOL_VERSION in sidecar/src/protocol.ts.
+const SidecarProtocolVersion = 1
+
+// Optional sidecar features reported in the handshake.
+const (
+	FeatureSendText    = "send_text"
+	FeatureSendImage   = "send_image"
+	FeatureSendSticker = "send_sticker"
+	FeatureSendFile    = "send_file"
+	FeatureSendVideo   = "send_video"
+	FeatureSendVoice   = "send_voice"
+	FeatureReactions   = "reactions"
+	FeatureUndo        = "undo"
+	FeatureGroupEvents = "group_events"
+	FeatureFriends     = "friends"
+	FeatureGroups      = "groups"
+	FeatureReplay      = "replay"
+	FeatureHistory     = "history"
+	FeatureUpload      = "upload"
+	FeatureStickers    = "stickers"
+	// Listing recently active threads, see SidecarClient.GetConversations.
+	FeatureConversations = "conversations"
+	// Fetching all stickers of a pack, see SidecarClient.GetStickerPack.
+	FeatureStickerPacks = "sticker_packs"
+)
+
+// knownFeatures lists the features this bridge can use, for logging what gets disabled.
+var knownFeatures = []string{
+	FeatureSendText, FeatureSendImage, FeatureSendSticker, FeatureSendFile,
+	FeatureSendVideo, FeatureSendVoice, FeatureReactions,
+	FeatureUndo, FeatureGroupEvents, FeatureFriends, FeatureGroups, FeatureReplay,
+	FeatureHistory, FeatureUpload, FeatureStickers, FeatureConversations,
+	FeatureStickerPacks,
+}
+
+// ErrSidecarIncompatible is returned when the sidecar speaks a different protocol version.
+var ErrSidecarIncompatible = errors.New("incompatible sidecar protocol")
+
+const handshakeTimeout = 10 * time.Second
+
+// SidecarHello is the handshake sent by the sidecar, both as the first WebSocket
+// frame and from GET /version.
+type SidecarHello struct {
+	ProtocolVersion int      `json:"protocolVersion"`
+	SidecarVersion  string   `json:"sidecarVersion"`
+	ZcaJSVersion    string   `json:"zcaJsVersion"`
+	Features        []string `json:"features"`
+	// Epoch of the session's event sequence numbers, only set in the WebSocket handshake.
+	Epoch string `json:"epoch,omitempty"`
+}
+
+// Check verifies that the sidecar speaks the same protocol version as the bridge.
+func (h *SidecarHello) Check() error {
+	if h.ProtocolVersion != SidecarProtocolVersion {
+		return fmt.Errorf(
+			"%w: sidecar %s (zca-js %s) speaks protocol v%d, but this bridge requires v%d; upgrade the older of the two",
+			ErrSidecarIncompatible, h.SidecarVersion, h.ZcaJSVersion, h.ProtocolVersion, SidecarProtocolVersion,
+		)
+	}
+	return nil
+}
+
+// HasFeature reports whether the sidecar advertised the given feature.
+func (h *SidecarHello) HasFeature(feature string) bool {
+	return h != nil && slices.Contains(h.Features, feature)
+}
+
+// MissingFeatures returns the known features the sidecar didn't advertise.
+func (h *SidecarHello) MissingFeatures() []string {
+	var missing []string
+	for _, feature := range knownFeatures {
+		if !h.HasFeature(feature) {
+			missing = append(missing, feature)
+		}
+	}
+	return missing
+}
+
+// readHandshake reads and validates the sidecar's welcome frame on a fresh WebSocket connection.
+func readHandshake(conn *websocket.Conn) (*SidecarHello, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("read sidecar handshake: %w", err)
+	}
+	var evt SidecarEvent
+	if err = json.Unmarshal(msg, &evt); err != nil {
+		return nil, fmt.Errorf("parse sidecar handshake: %w", err)
+	}
+	if evt.Type != "connection" {
+		return nil, fmt.Errorf("%w: expected connection handshake, got %q event", ErrSidecarIncompatible, evt.Type)
+	}
+	var hello SidecarHello
+	if err = json.Unmarshal(evt.Data, &hello); err != nil {
+		return nil, fmt.Errorf("parse sidecar handshake data: %w", err)
+	}
+	// Sidecars predating the handshake send no version and fail the check as v0.
+	if err = hello.Check(); err != nil {
+		return nil, err
+	}
+	return &hello, nil
+}
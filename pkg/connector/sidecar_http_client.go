@@ -7,27 +7,62 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
+// SidecarSessionHeader identifies which zca-js session a sidecar request belongs to.
+const SidecarSessionHeader = "X-Zalo-Session"
+
+// Headers describing an uploaded file: its URL-encoded name and its MIME type.
+const (
+	SidecarFileNameHeader = "X-File-Name"
+	SidecarFileTypeHeader = "X-File-Type"
+)
+
+// sidecarMediaTimeout bounds uploads and media sends, which move whole files.
+const sidecarMediaTimeout = 10 * time.Minute
+
 // SidecarClient wraps HTTP calls to the Node.js sidecar process.
 type SidecarClient struct {
-	baseURL    string
-	httpClient *http.Client
+	baseURL     string
+	sessionID   string
+	httpClient  *http.Client
+	mediaClient *http.Client
 }
 
-// NewSidecarClient creates a new sidecar HTTP client.
-func NewSidecarClient(baseURL string) *SidecarClient {
+// NewSidecarClient creates a new sidecar HTTP client scoped to a single session.
+// The session ID is the UserLoginID for logged-in users, or a temporary ID during login.
+func NewSidecarClient(baseURL, sessionID string) *SidecarClient {
 	return &SidecarClient{
-		baseURL: baseURL,
+		baseURL:   baseURL,
+		sessionID: sessionID,
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		mediaClient: &http.Client{
+			Timeout: sidecarMediaTimeout,
+		},
 	}
 }
 
+// sessionHeader returns the headers that scope a request to this client's session.
+func (s *SidecarClient) sessionHeader() http.Header {
+	h := make(http.Header)
+	if s.sessionID != "" {
+		h.Set(SidecarSessionHeader, s.sessionID)
+	}
+	return h
+}
+
 // doJSON performs a JSON request and decodes the response.
 func (s *SidecarClient) doJSON(ctx context.Context, method, path string, body any, result any) error {
+	return s.doJSONWith(ctx, s.httpClient, method, path, body, result)
+}
+
+// doJSONWith performs a JSON request with the given HTTP client and decodes the response.
+func (s *SidecarClient) doJSONWith(ctx context.Context, client *http.Client, method, path string, body any, result any) error {
 	var bodyReader io.Reader
 	if body != nil {
 		data, err := json.Marshal(body)
@@ -41,11 +76,16 @@ func (s *SidecarClient) doJSON(ctx context.Context, method, path string, body an
 	if err != nil {
 		return fmt.Errorf("create request: %w", err)
 	}
+	req.Header = s.sessionHeader()
 	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	return s.do(client, req, result)
+}
 
-	resp, err := s.httpClient.Do(req)
+// do sends a request and decodes the JSON response, turning sidecar error responses into errors.
+func (s *SidecarClient) do(client *http.Client, req *http.Request, result any) error {
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("do request: %w", err)
 	}
@@ -84,25 +124,79 @@ func (s *SidecarClient) LoginCookie(ctx context.Context, cookie, imei, userAgent
 }
 
 // SendText sends a text message via the sidecar.
-func (s *SidecarClient) SendText(ctx context.Context, msg, threadID string, threadType int, quote *string) (*SidecarSendResponse, error) {
+func (s *SidecarClient) SendText(ctx context.Context, msg, threadID string, threadType int, quote *SidecarQuoteRequest, mentions []SidecarMention, styles []SidecarTextStyle) (*SidecarSendResponse, error) {
 	body := map[string]any{
 		"msg":        msg,
 		"threadId":   threadID,
 		"threadType": threadType,
 	}
 	if quote != nil {
-		body["quote"] = *quote
+		body["quote"] = quote
+	}
+	if len(mentions) > 0 {
+		body["mentions"] = mentions
+	}
+	if len(styles) > 0 {
+		body["styles"] = styles
 	}
 	var resp SidecarSendResponse
 	err := s.doJSON(ctx, http.MethodPost, "/send/text", body, &resp)
 	return &resp, err
 }
 
-// SendImage sends an image message via the sidecar.
-func (s *SidecarClient) SendImage(ctx context.Context, filePath, threadID string, threadType int) (*SidecarSendResponse, error) {
+// Upload streams a file to the sidecar and returns an upload ID to pass to a media send.
+// The sidecar keeps the original file name, since Zalo shows it for files, and uses the
+// content type to add an extension if the name has none.
+func (s *SidecarClient) Upload(ctx context.Context, body io.Reader, size int64, fileName, contentType string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.baseURL+"/upload", body)
+	if err != nil {
+		return "", fmt.Errorf("create request: %w", err)
+	}
+	req.ContentLength = size
+	req.Header = s.sessionHeader()
+	// The body is always sent as a raw stream, with the real type in its own header
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(SidecarFileNameHeader, url.PathEscape(fileName))
+	if contentType != "" {
+		req.Header.Set(SidecarFileTypeHeader, contentType)
+	}
+	var resp SidecarUploadResponse
+	if err = s.do(s.mediaClient, req, &resp); err != nil {
+		return "", err
+	}
+	return resp.UploadID, nil
+}
+
+// SendImage sends an uploaded image via the sidecar.
+func (s *SidecarClient) SendImage(ctx context.Context, req *SidecarSendImageRequest) (*SidecarSendResponse, error) {
+	var resp SidecarSendResponse
+	err := s.doJSONWith(ctx, s.mediaClient, http.MethodPost, "/send/image", req, &resp)
+	return &resp, err
+}
+
+// SendFile sends an uploaded file via the sidecar.
+func (s *SidecarClient) SendFile(ctx context.Context, uploadID, threadID string, threadType int) (*SidecarSendResponse, error) {
+	var resp SidecarSendResponse
+	err := s.doJSONWith(ctx, s.mediaClient, http.MethodPost, "/send/file", map[string]any{
+		"uploadId":   uploadID,
+		"threadId":   threadID,
+		"threadType": threadType,
+	}, &resp)
+	return &resp, err
+}
+
+// SendVideo sends an uploaded video via the sidecar. Without a thumbnail, the sidecar sends it as a file.
+func (s *SidecarClient) SendVideo(ctx context.Context, req *SidecarSendVideoRequest) (*SidecarSendResponse, error) {
+	var resp SidecarSendResponse
+	err := s.doJSONWith(ctx, s.mediaClient, http.MethodPost, "/send/video", req, &resp)
+	return &resp, err
+}
+
+// SendVoice sends an uploaded voice message via the sidecar.
+func (s *SidecarClient) SendVoice(ctx context.Context, uploadID, threadID string, threadType int) (*SidecarSendResponse, error) {
 	var resp SidecarSendResponse
-	err := s.doJSON(ctx, http.MethodPost, "/send/image", map[string]any{
-		"filePath":   filePath,
+	err := s.doJSONWith(ctx, s.mediaClient, http.MethodPost, "/send/voice", map[string]any{
+		"uploadId":   uploadID,
 		"threadId":   threadID,
 		"threadType": threadType,
 	}, &resp)
@@ -157,6 +251,86 @@ func (s *SidecarClient) GetGroupInfo(ctx context.Context, groupID string) (*Side
 	return &wrapper.Group, err
 }
 
+// SearchStickers finds stickers in the Zalo catalog by keyword.
+func (s *SidecarClient) SearchStickers(ctx context.Context, keyword string) ([]SidecarSticker, error) {
+	var resp struct {
+		Stickers []SidecarSticker `json:"stickers"`
+	}
+	err := s.doJSON(ctx, http.MethodGet, "/stickers/search?"+url.Values{"keyword": {keyword}}.Encode(), nil, &resp)
+	return resp.Stickers, err
+}
+
+// GetStickerPack fetches all stickers of a pack.
+func (s *SidecarClient) GetStickerPack(ctx context.Context, packID string) ([]SidecarSticker, error) {
+	var resp struct {
+		Stickers []SidecarSticker `json:"stickers"`
+	}
+	err := s.doJSON(ctx, http.MethodGet, "/stickers/packs/"+url.PathEscape(packID), nil, &resp)
+	return resp.Stickers, err
+}
+
+// GetFriends fetches one page of the logged-in user's friend list.
+func (s *SidecarClient) GetFriends(ctx context.Context, count, page int) ([]SidecarFriend, error) {
+	var resp struct {
+		Friends []SidecarFriend `json:"friends"`
+	}
+	query := url.Values{}
+	query.Set("count", strconv.Itoa(count))
+	query.Set("page", strconv.Itoa(page))
+	err := s.doJSON(ctx, http.MethodGet, "/friends?"+query.Encode(), nil, &resp)
+	return resp.Friends, err
+}
+
+// GetGroupIDs fetches the IDs of all groups the logged-in user is in.
+func (s *SidecarClient) GetGroupIDs(ctx context.Context) ([]string, error) {
+	var resp struct {
+		Groups []struct {
+			GroupID string `json:"groupId"`
+		} `json:"groups"`
+	}
+	if err := s.doJSON(ctx, http.MethodGet, "/groups", nil, &resp); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(resp.Groups))
+	for i, group := range resp.Groups {
+		ids[i] = group.GroupID
+	}
+	return ids, nil
+}
+
+// GetHistory fetches up to count messages of a thread, oldest first.
+// A non-zero after returns the oldest messages newer than it, otherwise the newest
+// messages older than before (or the latest messages if before is zero).
+func (s *SidecarClient) GetHistory(ctx context.Context, threadID string, threadType int, before, after historyCursor, count int) (*SidecarHistoryResponse, error) {
+	query := url.Values{}
+	query.Set("threadType", strconv.Itoa(threadType))
+	query.Set("count", strconv.Itoa(count))
+	if before.Timestamp != 0 {
+		query.Set("before", strconv.FormatInt(before.Timestamp, 10))
+		if before.MsgID != "" {
+			query.Set("beforeMsgId", before.MsgID)
+		}
+	}
+	if after.Timestamp != 0 {
+		query.Set("after", strconv.FormatInt(after.Timestamp, 10))
+		if after.MsgID != "" {
+			query.Set("afterMsgId", after.MsgID)
+		}
+	}
+	var resp SidecarHistoryResponse
+	err := s.doJSON(ctx, http.MethodGet, "/history/"+url.PathEscape(threadID)+"?"+query.Encode(), nil, &resp)
+	return &resp, err
+}
+
+// GetConversations lists the recently active threads, newest first.
+func (s *SidecarClient) GetConversations(ctx context.Context) ([]SidecarConversation, error) {
+	var resp struct {
+		Conversations []SidecarConversation `json:"conversations"`
+	}
+	err := s.doJSON(ctx, http.MethodGet, "/conversations", nil, &resp)
+	return resp.Conversations, err
+}
+
 // GetSelfID returns the logged-in user's own Zalo ID.
 func (s *SidecarClient) GetSelfID(ctx context.Context) (string, error) {
 	var resp struct {
@@ -171,6 +345,13 @@ func (s *SidecarClient) Logout(ctx context.Context) error {
 	return s.doJSON(ctx, http.MethodPost, "/logout", nil, nil)
 }
 
+// GetVersion fetches the sidecar's protocol version and supported features.
+func (s *SidecarClient) GetVersion(ctx context.Context) (*SidecarHello, error) {
+	var resp SidecarHello
+	err := s.doJSON(ctx, http.MethodGet, "/version", nil, &resp)
+	return &resp, err
+}
+
 // Health checks sidecar availability.
 func (s *SidecarClient) Health(ctx context.Context) error {
 	return s.doJSON(ctx, http.MethodGet, "/health", nil, nil)
@@ -0,0 +1,205 @@
+package connector
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	sidecarMinBackoff   = time.Second
+	sidecarMaxBackoff   = 30 * time.Second
+	sidecarStableUptime = time.Minute
+	sidecarStopTimeout  = 10 * time.Second
+	// sidecarMaxLogLine is the longest output line logged, e.g. a stack trace or serialized message.
+	sidecarMaxLogLine = 1024 * 1024
+)
+
+// SidecarProcess launches the Node.js sidecar and restarts it when it exits unexpectedly.
+type SidecarProcess struct {
+	cfg     SidecarProcessConfig
+	baseURL string
+	log     zerolog.Logger
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	exited chan struct{}
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewSidecarProcess creates a supervisor for the sidecar serving baseURL.
+func NewSidecarProcess(cfg SidecarProcessConfig, baseURL string, log zerolog.Logger) *SidecarProcess {
+	return &SidecarProcess{
+		cfg:     cfg,
+		baseURL: baseURL,
+		log:     log,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start spawns the sidecar and keeps it running in the background until Stop is called.
+func (p *SidecarProcess) Start() error {
+	if err := p.spawn(); err != nil {
+		// Nothing is supervised, so Stop mustn't wait for it
+		close(p.done)
+		return err
+	}
+	go p.supervise()
+	return nil
+}
+
+// Stop asks the sidecar to shut down gracefully, killing it if it doesn't exit in time.
+func (p *SidecarProcess) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+	<-p.done
+}
+
+// WaitHealthy polls the sidecar health endpoint until it responds or the timeout passes.
+func (p *SidecarProcess) WaitHealthy(ctx context.Context, sidecar *SidecarClient) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.cfg.StartupTimeout)*time.Second)
+	defer cancel()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		err := sidecar.Health(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("sidecar didn't become healthy: %w", err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// spawn starts a single sidecar process and pipes its output into the bridge log.
+func (p *SidecarProcess) spawn() error {
+	cmd := exec.Command(p.cfg.NodePath, p.cfg.ScriptPath)
+	cmd.Dir = p.cfg.WorkDir
+	cmd.Env = os.Environ()
+	if u, err := url.Parse(p.baseURL); err == nil && u.Port() != "" {
+		cmd.Env = append(cmd.Env, "SIDECAR_PORT="+u.Port())
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("create sidecar stdout pipe: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("create sidecar stderr pipe: %w", err)
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("start sidecar process: %w", err)
+	}
+	p.log.Info().Int("pid", cmd.Process.Pid).Msg("Sidecar process started")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go p.pipeLog(&wg, stdout, zerolog.InfoLevel)
+	go p.pipeLog(&wg, stderr, zerolog.WarnLevel)
+
+	exited := make(chan struct{})
+	p.mu.Lock()
+	p.cmd = cmd
+	p.exited = exited
+	p.mu.Unlock()
+
+	go func() {
+		// Output must be fully drained before Wait closes the pipes.
+		wg.Wait()
+		err := cmd.Wait()
+		if err != nil {
+			p.log.Warn().Err(err).Msg("Sidecar process exited")
+		} else {
+			p.log.Info().Msg("Sidecar process exited")
+		}
+		close(exited)
+	}()
+	return nil
+}
+
+// supervise restarts the sidecar with exponential backoff whenever it exits.
+func (p *SidecarProcess) supervise() {
+	defer close(p.done)
+	backoff := sidecarMinBackoff
+	for {
+		p.mu.Lock()
+		exited := p.exited
+		p.mu.Unlock()
+
+		startedAt := time.Now()
+		select {
+		case <-exited:
+		case <-p.stop:
+			p.terminate(exited)
+			return
+		}
+		if time.Since(startedAt) > sidecarStableUptime {
+			backoff = sidecarMinBackoff
+		}
+		p.log.Warn().Dur("backoff", backoff).Msg("Sidecar exited unexpectedly, restarting")
+
+		for {
+			select {
+			case <-time.After(backoff):
+			case <-p.stop:
+				return
+			}
+			backoff = min(backoff*2, sidecarMaxBackoff)
+			err := p.spawn()
+			if err == nil {
+				break
+			}
+			p.log.Err(err).Dur("backoff", backoff).Msg("Failed to restart sidecar")
+		}
+	}
+}
+
+// terminate sends SIGTERM to the current sidecar process and kills it if it doesn't exit in time.
+func (p *SidecarProcess) terminate(exited chan struct{}) {
+	p.mu.Lock()
+	cmd := p.cmd
+	p.mu.Unlock()
+
+	p.log.Info().Msg("Stopping sidecar process")
+	_ = cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(sidecarStopTimeout):
+		p.log.Warn().Msg("Sidecar didn't exit in time, killing it")
+		_ = cmd.Process.Kill()
+		<-exited
+	}
+}
+
+// pipeLog forwards each line of the sidecar's output to the bridge logger. If a line is
+// too long to log, the rest of the output is discarded so the sidecar never blocks on a full pipe.
+func (p *SidecarProcess) pipeLog(wg *sync.WaitGroup, r io.Reader, level zerolog.Level) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), sidecarMaxLogLine)
+	for scanner.Scan() {
+		p.log.WithLevel(level).Str("stream", "sidecar").Msg(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		p.log.Warn().Err(err).Msg("Failed to read sidecar output, discarding the rest of it")
+		_, _ = io.Copy(io.Discard, r)
+	}
+}
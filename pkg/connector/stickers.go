@@ -0,0 +1,331 @@
+package connector
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/matrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/niconiconainu/mautrix-zalo/pkg/connector/zalodb"
+)
+
+// MSC2545 image pack event types.
+var (
+	StateRoomEmotes   = event.Type{Type: "im.ponies.room_emotes", Class: event.StateEventType}
+	AccountEmoteRooms = event.Type{Type: "im.ponies.emote_rooms", Class: event.AccountDataEventType}
+)
+
+// ImagePack is the content of an MSC2545 image pack.
+type ImagePack struct {
+	Images map[string]*PackImage `json:"images"`
+	Pack   PackInfo              `json:"pack"`
+}
+
+type PackInfo struct {
+	DisplayName string              `json:"display_name,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+	Usage       []string            `json:"usage,omitempty"`
+	Attribution string              `json:"attribution,omitempty"`
+}
+
+// PackImage is a sticker in an image pack. StickerID uses the same field as bridged
+// Zalo stickers, so clients that copy it into m.sticker events get native Zalo stickers.
+type PackImage struct {
+	URL       id.ContentURIString `json:"url"`
+	Body      string              `json:"body,omitempty"`
+	Info      *event.FileInfo     `json:"info,omitempty"`
+	StickerID string              `json:"io.github.niconiconainu.zalo.sticker_id,omitempty"`
+}
+
+// EmoteRooms is the content of the im.ponies.emote_rooms account data event,
+// which enables room image packs in all of a user's rooms.
+type EmoteRooms struct {
+	Rooms map[id.RoomID]map[string]map[string]any `json:"rooms"`
+}
+
+var HelpSectionStickers = commands.HelpSection{Name: "Stickers", Order: 30}
+
+var cmdStickers = &commands.FullHandler{
+	Func: fnStickers,
+	Name: "stickers",
+	Help: commands.HelpMeta{
+		Section: HelpSectionStickers,
+		Description: "Import Zalo sticker packs as Matrix image packs. `list` shows the packs used in your chats, " +
+			"`search <keyword>` finds more, `import <pack ID> [room|account]` publishes one in this room, " +
+			"or for all your rooms.",
+		Args: "<list|search|import> [_args_...]",
+	},
+	RequiresLogin: true,
+}
+
+const stickerPackStateKeyPrefix = "zalo_"
+
+const stickersUsage = "**Usage:** `$cmdprefix stickers list`, `$cmdprefix stickers search <keyword>` " +
+	"or `$cmdprefix stickers import <pack ID> [room|account]`"
+
+func fnStickers(ce *commands.Event) {
+	login := ce.User.GetDefaultLogin()
+	client, ok := login.Client.(*ZaloClient)
+	if !ok || !client.IsLoggedIn() {
+		ce.Reply("You're not connected to Zalo.")
+		return
+	} else if len(ce.Args) == 0 {
+		ce.Reply(stickersUsage)
+		return
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "list":
+		client.listStickerPacks(ce)
+	case "search":
+		if len(ce.Args) < 2 {
+			ce.Reply(stickersUsage)
+		} else if !client.hasFeature(FeatureStickers) {
+			ce.Reply("The sidecar doesn't support sticker search, update it to search sticker packs.")
+		} else {
+			client.searchStickerPacks(ce, strings.Join(ce.Args[1:], " "))
+		}
+	case "import":
+		if len(ce.Args) < 2 {
+			ce.Reply(stickersUsage)
+			return
+		} else if !client.hasFeature(FeatureStickerPacks) {
+			ce.Reply("The sidecar can't fetch sticker packs, update it to import them.")
+			return
+		}
+		target := "room"
+		if len(ce.Args) > 2 {
+			target = strings.ToLower(ce.Args[2])
+		}
+		if target != "room" && target != "account" {
+			ce.Reply("The target must be `room` or `account`.")
+			return
+		}
+		client.importStickerPack(ce, ce.Args[1], target == "account")
+	default:
+		ce.Reply("Unknown subcommand `%s`. Use `list`, `search` or `import`.", ce.Args[0])
+	}
+}
+
+// rememberStickerPack records that a sticker pack was used in the login's chats, for listing it later.
+func (c *ZaloClient) rememberStickerPack(ctx context.Context, packID string, usedAt time.Time) {
+	err := c.connector.DB.StickerPacks.Put(ctx, &zalodb.StickerPack{
+		LoginID:  c.userLogin.ID,
+		PackID:   packID,
+		LastUsed: usedAt,
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("pack_id", packID).Msg("Failed to remember sticker pack")
+	}
+}
+
+// listStickerPacks lists the packs of the stickers sent and received in the login's chats.
+// zca-js can't list the packs an account owns, so this is the closest there is.
+func (c *ZaloClient) listStickerPacks(ce *commands.Event) {
+	packs, err := c.connector.DB.StickerPacks.GetAll(ce.Ctx, c.userLogin.ID)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to get sticker packs")
+		ce.Reply("Failed to get sticker packs: %v", err)
+		return
+	} else if len(packs) == 0 {
+		ce.Reply("No stickers were bridged from your chats yet. Find packs with `$cmdprefix stickers search <keyword>`.")
+		return
+	}
+	lines := make([]string, 0, len(packs)+2)
+	lines = append(lines, "Sticker packs used in your chats, most recent first:")
+	for _, pack := range packs {
+		lines = append(lines, fmt.Sprintf("* `%s` - last used %s", pack.PackID, pack.LastUsed.Format(time.DateOnly)))
+	}
+	lines = append(lines, "", "Import one with `$cmdprefix stickers import <pack ID> [room|account]`.")
+	ce.Reply(strings.Join(lines, "\n"))
+}
+
+// searchStickerPacks lists the packs of the stickers matching a keyword.
+func (c *ZaloClient) searchStickerPacks(ce *commands.Event, keyword string) {
+	stickers, err := c.sidecar.SearchStickers(ce.Ctx, keyword)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to search stickers")
+		ce.Reply("Failed to search stickers: %v", err)
+		return
+	} else if len(stickers) == 0 {
+		ce.Reply("No stickers found for %q.", keyword)
+		return
+	}
+
+	matches := make(map[string]int)
+	for _, sticker := range stickers {
+		matches[sticker.PackID]++
+	}
+	packIDs := slices.SortedFunc(maps.Keys(matches), func(a, b string) int {
+		return cmp.Compare(matches[b], matches[a])
+	})
+	lines := make([]string, 0, len(packIDs)+2)
+	lines = append(lines, fmt.Sprintf("Found %d sticker packs for %q:", len(packIDs), keyword))
+	for _, packID := range packIDs {
+		lines = append(lines, fmt.Sprintf("* `%s` - %d matching stickers", packID, matches[packID]))
+	}
+	lines = append(lines, "", "Import one with `$cmdprefix stickers import <pack ID> [room|account]`.")
+	ce.Reply(strings.Join(lines, "\n"))
+}
+
+// importStickerPack uploads the stickers of a pack and publishes them as an image pack
+// in the command room. With forAccount, the pack is also enabled in all of the user's rooms.
+func (c *ZaloClient) importStickerPack(ce *commands.Event, packID string, forAccount bool) {
+	stickers, err := c.sidecar.GetStickerPack(ce.Ctx, packID)
+	if err != nil {
+		ce.Log.Err(err).Str("pack_id", packID).Msg("Failed to get sticker pack")
+		ce.Reply("Failed to get sticker pack `%s`: %v", packID, err)
+		return
+	}
+	stickers = slices.DeleteFunc(stickers, func(sticker SidecarSticker) bool {
+		return sticker.URL == ""
+	})
+	if len(stickers) == 0 {
+		ce.Reply("Sticker pack `%s` doesn't exist or has no stickers.", packID)
+		return
+	}
+
+	var doublePuppet bridgev2.MatrixAPI
+	if forAccount {
+		if doublePuppet = ce.User.DoublePuppet(ce.Ctx); doublePuppet == nil {
+			ce.Reply("Enabling packs for your account needs double puppeting.")
+			return
+		}
+	}
+
+	pack := &ImagePack{
+		Images: make(map[string]*PackImage, len(stickers)),
+		Pack: PackInfo{
+			DisplayName: "Zalo stickers " + packID,
+			Usage:       []string{"sticker"},
+			Attribution: "Zalo",
+		},
+	}
+	var failed int
+	for _, sticker := range stickers {
+		media, err := c.uploadPackSticker(ce.Ctx, ce.Bot, &sticker)
+		if err != nil {
+			ce.Log.Warn().Err(err).Str("sticker_id", sticker.ID).Msg("Failed to upload sticker for pack")
+			failed++
+			continue
+		}
+		body := sticker.Text
+		if body == "" {
+			body = "sticker"
+		}
+		pack.Images[stickerPackStateKeyPrefix+sticker.ID] = &PackImage{
+			URL:  media.URL,
+			Body: body,
+			Info: &event.FileInfo{
+				MimeType:   media.MimeType,
+				Size:       int(media.Size),
+				Width:      media.Image.Width,
+				Height:     media.Image.Height,
+				IsAnimated: media.Image.Animated,
+			},
+			StickerID: sticker.ID,
+		}
+		if pack.Pack.AvatarURL == "" {
+			pack.Pack.AvatarURL = media.URL
+		}
+	}
+	if len(pack.Images) == 0 {
+		ce.Reply("Failed to upload the stickers of pack `%s`.", packID)
+		return
+	}
+
+	// The bot administers portals, but management rooms belong to the user
+	intent := ce.Bot
+	if ce.Portal == nil {
+		if dp := ce.User.DoublePuppet(ce.Ctx); dp != nil {
+			intent = dp
+		}
+	}
+	stateKey := stickerPackStateKeyPrefix + packID
+	_, err = intent.SendState(ce.Ctx, ce.RoomID, StateRoomEmotes, stateKey, &event.Content{Parsed: pack}, time.Time{})
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to send image pack")
+		ce.Reply("Failed to publish the pack in this room: %v", err)
+		return
+	}
+	if forAccount {
+		if err = enableEmoteRoom(ce.Ctx, doublePuppet, ce.RoomID, stateKey); err != nil {
+			ce.Log.Err(err).Msg("Failed to enable image pack for account")
+			ce.Reply("Published the pack in this room, but failed to enable it for your account: %v", err)
+			return
+		}
+	}
+
+	where := "this room"
+	if forAccount {
+		where = "all your rooms"
+	}
+	if failed > 0 {
+		ce.Reply("Imported %d stickers into %s (%d failed).", len(pack.Images), where, failed)
+	} else {
+		ce.Reply("Imported %d stickers into %s.", len(pack.Images), where)
+	}
+}
+
+// uploadPackSticker uploads a sticker for an image pack, reusing the upload of the same
+// sticker from the media cache. Packs aren't tied to a room, so the upload is never encrypted.
+func (c *ZaloClient) uploadPackSticker(ctx context.Context, intent bridgev2.MatrixAPI, sticker *SidecarSticker) (*uploadedMedia, error) {
+	key := stickerMediaKey(sticker.ID)
+	if cached := c.connector.getCachedMedia(ctx, key, false); cached != nil {
+		return cached, nil
+	}
+	maxSize := c.connector.Config.Media.maxSize(mediaKindImage)
+	media, err := c.connector.Media.streamToMatrix(ctx, intent, "", sticker.URL, "sticker", "", mediaKindImage, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	c.connector.cacheMedia(ctx, key, media.cacheEntry())
+	return media, nil
+}
+
+// enableEmoteRoom adds a room image pack to the user's im.ponies.emote_rooms account data.
+func enableEmoteRoom(ctx context.Context, doublePuppet bridgev2.MatrixAPI, roomID id.RoomID, stateKey string) error {
+	asIntent, ok := doublePuppet.(*matrix.ASIntent)
+	if !ok {
+		return fmt.Errorf("account data isn't supported by this Matrix connector")
+	}
+	var emoteRooms EmoteRooms
+	err := asIntent.Matrix.GetAccountData(ctx, AccountEmoteRooms.Type, &emoteRooms)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return fmt.Errorf("failed to get emote rooms: %w", err)
+	}
+	if emoteRooms.Rooms == nil {
+		emoteRooms.Rooms = make(map[id.RoomID]map[string]map[string]any)
+	}
+	if emoteRooms.Rooms[roomID] == nil {
+		emoteRooms.Rooms[roomID] = make(map[string]map[string]any)
+	}
+	emoteRooms.Rooms[roomID][stateKey] = map[string]any{}
+	return asIntent.Matrix.SetAccountData(ctx, AccountEmoteRooms.Type, &emoteRooms)
+}
+
+// stickerIDForMXC maps a sticker from an imported pack back to its Zalo sticker ID.
+func (c *ZaloClient) stickerIDForMXC(ctx context.Context, mxc id.ContentURIString) string {
+	if mxc == "" {
+		return ""
+	}
+	cached, err := c.connector.DB.Media.GetByMXC(ctx, mxc, stickerMediaKey(""))
+	if err != nil {
+		c.log.Warn().Err(err).Msg("Failed to look up sticker by MXC URI")
+		return ""
+	} else if cached == nil {
+		return ""
+	}
+	return strings.TrimPrefix(cached.Key, stickerMediaKey(""))
+}
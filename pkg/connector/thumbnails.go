@@ -0,0 +1,117 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/color"
+	"image/jpeg"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/exmime"
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+const (
+	// thumbnailSize is the largest width or height of thumbnails.
+	thumbnailSize = 640
+	// maxThumbnailSourceSize caps images downloaded to make thumbnails from, which are decoded in memory.
+	maxThumbnailSourceSize = 10 * 1024 * 1024
+	// blurhashSourceSize is what images are scaled down to before computing their blurhash,
+	// which only keeps a few colour components anyway.
+	blurhashSourceSize = 64
+)
+
+// thumbnail is a thumbnail image ready for uploading.
+type thumbnail struct {
+	Data     []byte
+	MimeType string
+	Width    int
+	Height   int
+	Blurhash string
+}
+
+// makeThumbnail scales an image down to fit thumbnailSize and computes its blurhash. JPEG and PNG
+// images that are already small enough are kept as they are; others are re-encoded as JPEG.
+func makeThumbnail(data []byte) (*thumbnail, error) {
+	img, format, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("thumbnail source: %w", err)
+	}
+	hash, err := blurhash.Encode(4, 3, scaleToFit(img, blurhashSourceSize, color.White))
+	if err != nil {
+		return nil, fmt.Errorf("compute blurhash: %w", err)
+	}
+
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width <= thumbnailSize && height <= thumbnailSize && (format == "jpeg" || format == "png") {
+		return &thumbnail{Data: data, MimeType: "image/" + format, Width: width, Height: height, Blurhash: hash}, nil
+	}
+	scaled := scaleToFit(img, thumbnailSize, color.White)
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, fmt.Errorf("encode thumbnail: %w", err)
+	}
+	return &thumbnail{
+		Data:     buf.Bytes(),
+		MimeType: "image/jpeg",
+		Width:    scaled.Bounds().Dx(),
+		Height:   scaled.Bounds().Dy(),
+		Blurhash: hash,
+	}, nil
+}
+
+// reuploadThumbnail adds a thumbnail and blurhash to the message's uploaded image or video. Zalo's own
+// thumbnail is used if there is one, otherwise images are thumbnailed from the full file. Thumbnails are
+// cached along with the media under key, if it's set. Failures are only logged, since the message is
+// complete without a thumbnail.
+func (m *ZaloRemoteMessage) reuploadThumbnail(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, key string, kind mediaKind, media *uploadedMedia) {
+	log := zerolog.Ctx(ctx)
+	connector := m.client.connector
+	source := m.data.Thumb
+	if source == "" && kind == mediaKindImage && media.Size <= maxThumbnailSourceSize {
+		source = m.data.MediaURL
+	}
+	if source == "" {
+		return
+	}
+
+	var encrypted, cacheable bool
+	if key != "" {
+		key = thumbnailMediaKey(key)
+		encrypted, cacheable = roomEncrypted(ctx, connector.Bridge, portal.MXID)
+	}
+	if cacheable {
+		if cached := connector.getCachedMedia(ctx, key, encrypted); cached != nil {
+			media.Thumbnail = cached
+			return
+		}
+	}
+
+	data, err := connector.Media.download(ctx, source, maxThumbnailSourceSize)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to download thumbnail source")
+		return
+	}
+	thumb, err := makeThumbnail(data)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to make thumbnail")
+		return
+	}
+	uploaded := &uploadedMedia{
+		MimeType: thumb.MimeType,
+		Size:     int64(len(thumb.Data)),
+		Image:    imageInfo{Width: thumb.Width, Height: thumb.Height},
+		Blurhash: thumb.Blurhash,
+	}
+	uploaded.URL, uploaded.File, err = intent.UploadMedia(ctx, portal.MXID, thumb.Data, "thumbnail"+exmime.ExtensionFromMimetype(thumb.MimeType), thumb.MimeType)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to upload thumbnail")
+		return
+	}
+	media.Thumbnail = uploaded
+	if cacheable {
+		connector.cacheMedia(ctx, key, uploaded.cacheEntry())
+	}
+}
@@ -16,24 +16,30 @@ const (
 
 // MakePortalKey creates a PortalKey from Zalo thread ID and type.
 // Format: "threadId:threadType"
-func MakePortalKey(threadID string, threadType int) networkid.PortalKey {
-	return networkid.PortalKey{
-		ID:       networkid.PortalID(fmt.Sprintf("%s:%d", threadID, threadType)),
-		Receiver: "",
+//
+// A DM's thread ID is the other user's ID, so DMs are keyed per receiving login
+// to give each bridge user their own room. Groups are shared unless split portals is enabled.
+func MakePortalKey(threadID string, threadType int, receiver networkid.UserLoginID, splitPortals bool) networkid.PortalKey {
+	key := networkid.PortalKey{
+		ID: networkid.PortalID(fmt.Sprintf("%s:%d", threadID, threadType)),
 	}
+	if threadType == ThreadTypeUser || splitPortals {
+		key.Receiver = receiver
+	}
+	return key
 }
 
 // ParsePortalKey extracts thread ID and type from a PortalKey.
-func ParsePortalKey(key networkid.PortalKey) (threadID string, threadType int) {
+func ParsePortalKey(key networkid.PortalKey) (threadID string, threadType int, err error) {
 	parts := strings.SplitN(string(key.ID), ":", 2)
-	if len(parts) != 2 {
-		return string(key.ID), ThreadTypeUser
+	if len(parts) != 2 || parts[0] == "" {
+		return "", 0, fmt.Errorf("malformed portal ID %q", key.ID)
 	}
-	t, err := strconv.Atoi(parts[1])
-	if err != nil {
-		return parts[0], ThreadTypeUser
+	threadType, err = strconv.Atoi(parts[1])
+	if err != nil || (threadType != ThreadTypeUser && threadType != ThreadTypeGroup) {
+		return "", 0, fmt.Errorf("invalid thread type in portal ID %q", key.ID)
 	}
-	return parts[0], t
+	return parts[0], threadType, nil
 }
 
 // MakeUserID creates a networkid.UserID from a Zalo user ID string.
@@ -50,26 +56,122 @@ type SidecarLoginResponse struct {
 	UserAgent string `json:"userAgent"`
 }
 
+// SidecarQuote is the message quoted by an incoming Zalo message.
+type SidecarQuote struct {
+	MsgID      string `json:"msgId"`
+	CliMsgID   string `json:"cliMsgId"`
+	SenderID   string `json:"senderId"`
+	SenderName string `json:"senderName"`
+	Content    string `json:"content"`
+}
+
+// SidecarMention is a mention range in a Zalo message, in UTF-16 code units.
+type SidecarMention struct {
+	UID string `json:"uid"`
+	Pos int    `json:"pos"`
+	Len int    `json:"len"`
+}
+
+// SidecarTextStyle is a style range in a Zalo message, in UTF-16 code units.
+// Style is a Zalo style code such as "b", "i" or "c_ff0000".
+type SidecarTextStyle struct {
+	Start int    `json:"start"`
+	Len   int    `json:"len"`
+	Style string `json:"st"`
+}
+
+// SidecarSendImageRequest is the request body for sending an image. The dimensions
+// are shown by Zalo before the image loads. Mentions and styles are ranges in Caption.
+type SidecarSendImageRequest struct {
+	UploadID   string             `json:"uploadId"`
+	Width      int                `json:"width,omitempty"`
+	Height     int                `json:"height,omitempty"`
+	Caption    string             `json:"caption,omitempty"`
+	Mentions   []SidecarMention   `json:"mentions,omitempty"`
+	Styles     []SidecarTextStyle `json:"styles,omitempty"`
+	ThreadID   string             `json:"threadId"`
+	ThreadType int                `json:"threadType"`
+}
+
+// SidecarSendVideoRequest is the request body for sending a video.
+type SidecarSendVideoRequest struct {
+	UploadID          string `json:"uploadId"`
+	ThumbnailUploadID string `json:"thumbnailUploadId,omitempty"`
+	Duration          int    `json:"duration,omitempty"`
+	Width             int    `json:"width,omitempty"`
+	Height            int    `json:"height,omitempty"`
+	ThreadID          string `json:"threadId"`
+	ThreadType        int    `json:"threadType"`
+}
+
+// SidecarUploadResponse is returned by the sidecar for an uploaded file.
+type SidecarUploadResponse struct {
+	UploadID string `json:"uploadId"`
+	Size     int64  `json:"size"`
+}
+
+// SidecarQuoteRequest identifies the message to quote when sending a reply.
+type SidecarQuoteRequest struct {
+	MsgID    string `json:"msgId"`
+	CliMsgID string `json:"cliMsgId,omitempty"`
+	SenderID string `json:"senderId"`
+	Content  string `json:"content,omitempty"`
+	MsgType  string `json:"msgType,omitempty"`
+	TS       int64  `json:"ts,omitempty"`
+}
+
 type SidecarSendResponse struct {
 	MessageID string `json:"messageId"`
+	// Zalo's client message ID, needed to quote the message. Empty if the sidecar didn't see it.
+	CliMsgID string `json:"cliMsgId,omitempty"`
 }
 
 type SidecarUserInfoResponse struct {
-	ID          string `json:"id"`
+	ID          string `json:"userId"`
 	DisplayName string `json:"displayName"`
-	AvatarURL   string `json:"avatarUrl"`
+	AvatarURL   string `json:"avatar"`
 }
 
 type SidecarGroupInfoResponse struct {
-	ID      string               `json:"id"`
+	ID      string               `json:"groupId"`
 	Name    string               `json:"name"`
-	Avatar  string               `json:"avatarUrl"`
+	Avatar  string               `json:"avatar"`
 	Members []SidecarGroupMember `json:"members"`
+	Admins  []string             `json:"adminIds"`
+	Creator string               `json:"creatorId"`
 }
 
 type SidecarGroupMember struct {
 	UserID      string `json:"userId"`
 	DisplayName string `json:"displayName"`
+	Avatar      string `json:"avatar"`
+}
+
+type SidecarFriend struct {
+	UserID         string `json:"userId"`
+	DisplayName    string `json:"displayName"`
+	Avatar         string `json:"avatar"`
+	LastActionTime int64  `json:"lastActionTime"`
+}
+
+type SidecarHistoryResponse struct {
+	Messages []SidecarMessageData `json:"messages"`
+	HasMore  bool                 `json:"hasMore"`
+}
+
+// SidecarConversation is a recently active thread and the time of its latest message (ms).
+type SidecarConversation struct {
+	ThreadID        string `json:"threadId"`
+	ThreadType      int    `json:"threadType"`
+	LastMessageTime int64  `json:"lastMessageTime"`
+}
+
+// SidecarSticker is a sticker from the Zalo catalog. PackID is its category.
+type SidecarSticker struct {
+	ID     string `json:"id"`
+	PackID string `json:"packId"`
+	Text   string `json:"text"`
+	URL    string `json:"url"`
 }
 
 type SidecarHealthResponse struct {
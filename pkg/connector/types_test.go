@@ -0,0 +1,55 @@
+package connector
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestParsePortalKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		threadID   string
+		threadType int
+		wantErr    bool
+	}{
+		{name: "user", id: "123:0", threadID: "123", threadType: ThreadTypeUser},
+		{name: "group", id: "456:1", threadID: "456", threadType: ThreadTypeGroup},
+		{name: "extra separator", id: "a:b:1", wantErr: true},
+		{name: "no separator", id: "123", wantErr: true},
+		{name: "empty thread ID", id: ":0", wantErr: true},
+		{name: "empty type", id: "123:", wantErr: true},
+		{name: "unknown type", id: "123:2", wantErr: true},
+		{name: "negative type", id: "123:-1", wantErr: true},
+		{name: "non-numeric type", id: "123:group", wantErr: true},
+		{name: "empty", id: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			threadID, threadType, err := ParsePortalKey(networkid.PortalKey{ID: networkid.PortalID(tt.id)})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParsePortalKey(%q) = %q, %d, want error", tt.id, threadID, threadType)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePortalKey(%q) returned error: %v", tt.id, err)
+			}
+			if threadID != tt.threadID || threadType != tt.threadType {
+				t.Errorf("ParsePortalKey(%q) = %q, %d, want %q, %d", tt.id, threadID, threadType, tt.threadID, tt.threadType)
+			}
+		})
+	}
+}
+
+func TestMakePortalKeyRoundTrip(t *testing.T) {
+	for _, threadType := range []int{ThreadTypeUser, ThreadTypeGroup} {
+		key := MakePortalKey("789", threadType, "login", false)
+		threadID, parsedType, err := ParsePortalKey(key)
+		if err != nil || threadID != "789" || parsedType != threadType {
+			t.Errorf("round trip of type %d = %q, %d, %v", threadType, threadID, parsedType, err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ffmpeg"
+	"go.mau.fi/util/ffmpeg/waveform"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+// Matrix voice messages (MSC3245) are Ogg/Opus, while Zalo records and plays AAC in an MP4 container.
+var (
+	toMatrixVoiceArgs = []string{"-vn", "-c:a", "libopus", "-b:a", "32k"}
+	toZaloVoiceArgs   = []string{"-vn", "-c:a", "aac", "-b:a", "64k", "-movflags", "+faststart"}
+)
+
+// zaloVoiceTypes are the audio types Zalo plays as voice messages without transcoding.
+var zaloVoiceTypes = []string{"audio/mp4", "audio/aac", "audio/x-m4a", "audio/m4a"}
+
+// waveformSamples is the number of points in voice message waveforms, which range from 0 to 1024 (MSC3246).
+const waveformSamples = 100
+
+// setupFFmpeg points the ffmpeg helpers at the configured binary. Without one,
+// voice messages are bridged as files and animated stickers aren't converted.
+func (z *ZaloConnector) setupFFmpeg() {
+	log := z.Bridge.Log.With().Str("component", "ffmpeg").Logger()
+	path := z.Config.Media.FFmpegPath
+	if path == "" {
+		path = "ffmpeg"
+	}
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		ffmpeg.SetPath("")
+		log.Warn().Err(err).Str("ffmpeg_path", path).
+			Msg("ffmpeg not found, voice messages will be bridged as plain files")
+		return
+	}
+	ffmpeg.SetPath(resolved)
+	log.Debug().Str("ffmpeg_path", resolved).Msg("Using ffmpeg for media conversion")
+}
+
+// convertVoiceMessage converts a Zalo voice message to a Matrix voice message with a waveform. Without ffmpeg,
+// or with direct media, which serves files as they are on Zalo, it's bridged as a plain file instead.
+func (m *ZaloRemoteMessage) convertVoiceMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI) (*bridgev2.ConvertedMessage, error) {
+	if m.data.MediaURL == "" {
+		return m.convertTextMessage(ctx, nil)
+	} else if !ffmpeg.Supported() || m.client.connector.directMedia {
+		return m.convertFileMessage(ctx, portal, intent)
+	}
+
+	media, wave, err := m.transcodeVoice(ctx, portal, intent)
+	var tooLarge *mediaTooLargeError
+	if errors.As(err, &tooLarge) {
+		return nil, tooLarge
+	} else if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to transcode voice message, bridging it as a file")
+		return m.convertFileMessage(ctx, portal, intent)
+	}
+
+	content := &event.MessageEventContent{
+		MsgType:  event.MsgAudio,
+		Body:     "voice.ogg",
+		FileName: "voice.ogg",
+		Info: &event.FileInfo{
+			Duration: m.data.Duration,
+		},
+		MSC1767Audio: &event.MSC1767Audio{
+			Duration: m.data.Duration,
+			Waveform: wave,
+		},
+		MSC3245Voice: &event.MSC3245Voice{},
+	}
+	media.apply(content)
+
+	return &bridgev2.ConvertedMessage{
+		Parts: []*bridgev2.ConvertedMessagePart{{
+			Type:    event.EventMessage,
+			Content: content,
+		}},
+	}, nil
+}
+
+// transcodeVoice downloads a Zalo voice clip, converts it to Ogg/Opus and uploads it to Matrix.
+// The waveform is left empty if it couldn't be generated.
+func (m *ZaloRemoteMessage) transcodeVoice(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI) (*uploadedMedia, []int, error) {
+	connector := m.client.connector
+	maxSize := connector.Config.Media.maxSize(mediaKindVoice)
+	resp, err := connector.Media.open(ctx, m.data.MediaURL, mediaKindVoice, maxSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	input, err := os.CreateTemp("", "zalo-voice-*.m4a")
+	if err != nil {
+		return nil, nil, fmt.Errorf("create temp file: %w", err)
+	}
+	_, err = limitedCopy(input, resp.Body, mediaKindVoice, maxSize)
+	_ = input.Close()
+	if err != nil {
+		_ = os.Remove(input.Name())
+		return nil, nil, err
+	}
+	output, err := ffmpeg.ConvertPath(ctx, input.Name(), ".ogg", nil, toMatrixVoiceArgs, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(output)
+
+	wave, err := waveform.Generate(ctx, output, waveformSamples, 1024)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to generate voice message waveform")
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read transcoded voice: %w", err)
+	} else if err = checkSize(mediaKindVoice, int64(len(data)), maxSize); err != nil {
+		return nil, nil, err
+	}
+	media := &uploadedMedia{MimeType: "audio/ogg", Size: int64(len(data))}
+	media.URL, media.File, err = intent.UploadMedia(ctx, portal.MXID, data, "voice.ogg", media.MimeType)
+	if err != nil {
+		return nil, nil, fmt.Errorf("upload to matrix: %w", err)
+	}
+	return media, wave, nil
+}
+
+// canSendVoice reports whether a Matrix voice message can be sent as a Zalo voice message,
+// which needs ffmpeg unless it's already in a format Zalo plays.
+func canSendVoice(content *event.MessageEventContent) bool {
+	return ffmpeg.Supported() || (content.Info != nil && slices.Contains(zaloVoiceTypes, content.Info.MimeType))
+}
+
+// uploadMatrixVoice streams a Matrix voice message to the sidecar, transcoding it to AAC unless Zalo plays it as is.
+func (c *ZaloClient) uploadMatrixVoice(ctx context.Context, content *event.MessageEventContent) (string, error) {
+	if content.Info != nil && slices.Contains(zaloVoiceTypes, content.Info.MimeType) {
+		return c.uploadMatrixMedia(ctx, content, mediaKindVoice)
+	} else if !c.hasFeature(FeatureUpload) {
+		return "", bridgev2.ErrUnsupportedMessageType
+	}
+	var expectedSize int64
+	if content.Info != nil {
+		expectedSize = int64(content.Info.Size)
+	}
+	maxSize := c.connector.Config.Media.maxSize(mediaKindVoice)
+	var uploadID string
+	err := streamMatrixMedia(ctx, c.connector.Bridge.Bot, content.URL, content.File, expectedSize, mediaKindVoice, maxSize, func(file *os.File, _ int64) error {
+		output, err := ffmpeg.ConvertPath(ctx, file.Name(), ".m4a", nil, toZaloVoiceArgs, false)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(output)
+		converted, err := os.Open(output)
+		if err != nil {
+			return err
+		}
+		defer converted.Close()
+		info, err := converted.Stat()
+		if err != nil {
+			return err
+		} else if err = checkSize(mediaKindVoice, info.Size(), maxSize); err != nil {
+			return err
+		}
+		uploadID, err = c.sidecar.Upload(ctx, converted, info.Size(), "voice.m4a", "audio/mp4")
+		return err
+	})
+	if err != nil {
+		return "", tooLargeStatus(err)
+	}
+	return uploadID, nil
+}
@@ -0,0 +1,38 @@
+// Package zalodb contains the connector-owned tables of the Zalo bridge.
+package zalodb
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+
+	"github.com/niconiconainu/mautrix-zalo/pkg/connector/zalodb/upgrades"
+)
+
+// Database wraps the bridge database with the Zalo connector's own version table.
+type Database struct {
+	*dbutil.Database
+	BridgeID networkid.BridgeID
+
+	Media        *MediaQuery
+	StickerPacks *StickerPackQuery
+}
+
+// New creates a child database of the bridge DB. Call Upgrade before using it.
+func New(bridgeID networkid.BridgeID, db *dbutil.Database, log zerolog.Logger) *Database {
+	db = db.Child("zalo_version", upgrades.Table, dbutil.ZeroLogger(log))
+	return &Database{
+		Database:     db,
+		BridgeID:     bridgeID,
+		Media:        newMediaQuery(bridgeID, db),
+		StickerPacks: newStickerPackQuery(bridgeID, db),
+	}
+}
+
+// Upgrade brings the connector's tables up to date. Some upgrades migrate the bridge's shared
+// tables, so they're scoped to this bridge's rows.
+func (db *Database) Upgrade(ctx context.Context) error {
+	return db.Database.Upgrade(upgrades.WithBridgeID(ctx, db.BridgeID))
+}
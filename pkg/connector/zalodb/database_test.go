@@ -0,0 +1,140 @@
+package zalodb
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// newTestBridgeDB creates an in-memory bridge database with the given logins of one user.
+func newTestBridgeDB(t *testing.T, logins ...networkid.UserLoginID) (*dbutil.Database, map[networkid.BridgeID]*database.Database) {
+	t.Helper()
+	rawDB, err := sql.Open("sqlite3", "file::memory:?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = rawDB.Close() })
+	db, err := dbutil.NewWithDB(rawDB, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	bridges := make(map[networkid.BridgeID]*database.Database)
+	for _, bridgeID := range []networkid.BridgeID{"zalo", "other"} {
+		bdb := database.New(bridgeID, database.MetaTypes{}, db)
+		if bridgeID == "zalo" {
+			if err = bdb.Upgrade(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = bdb.User.Insert(ctx, &database.User{BridgeID: bridgeID, MXID: "@user:example.com"}); err != nil {
+			t.Fatal(err)
+		}
+		for _, loginID := range logins {
+			err = bdb.UserLogin.Insert(ctx, &database.UserLogin{BridgeID: bridgeID, UserMXID: "@user:example.com", ID: loginID})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		bridges[bridgeID] = bdb
+	}
+	return db, bridges
+}
+
+func addPortal(t *testing.T, bdb *database.Database, key networkid.PortalKey, preferredLogin networkid.UserLoginID, logins ...networkid.UserLoginID) {
+	t.Helper()
+	ctx := context.Background()
+	if err := bdb.Portal.Insert(ctx, &database.Portal{BridgeID: bdb.BridgeID, PortalKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	for _, loginID := range logins {
+		preferred := loginID == preferredLogin
+		err := bdb.UserPortal.Put(ctx, &database.UserPortal{
+			BridgeID:  bdb.BridgeID,
+			UserMXID:  "@user:example.com",
+			LoginID:   loginID,
+			Portal:    key,
+			Preferred: &preferred,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func portalKeys(t *testing.T, bdb *database.Database) map[networkid.PortalKey]bool {
+	t.Helper()
+	portals, err := bdb.Portal.GetAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[networkid.PortalKey]bool, len(portals))
+	for _, portal := range portals {
+		keys[portal.PortalKey] = true
+	}
+	return keys
+}
+
+func checkPortals(t *testing.T, bdb *database.Database, want ...networkid.PortalKey) {
+	t.Helper()
+	got := portalKeys(t, bdb)
+	if len(got) != len(want) {
+		t.Errorf("bridge %s has portals %v, want %v", bdb.BridgeID, got, want)
+	}
+	for _, key := range want {
+		if !got[key] {
+			t.Errorf("bridge %s is missing portal %v, has %v", bdb.BridgeID, key, got)
+		}
+	}
+}
+
+func TestUpgradeDMPortalReceiver(t *testing.T) {
+	db, bridges := newTestBridgeDB(t, "a", "b")
+	zalo, other := bridges["zalo"], bridges["other"]
+	// a already has its own portal for the chat, so the shared one goes to b
+	addPortal(t, zalo, networkid.PortalKey{ID: "1:0", Receiver: "a"}, "a", "a")
+	addPortal(t, zalo, networkid.PortalKey{ID: "1:0"}, "a", "a", "b")
+	// The preferred login wins
+	addPortal(t, zalo, networkid.PortalKey{ID: "2:0"}, "b", "a", "b")
+	// Without anyone in it and with several logins, nobody can own it
+	addPortal(t, zalo, networkid.PortalKey{ID: "3:0"}, "")
+	// Groups keep having no receiver
+	addPortal(t, zalo, networkid.PortalKey{ID: "4:1"}, "a", "a")
+	// Other bridges in the same database aren't touched
+	addPortal(t, other, networkid.PortalKey{ID: "5:0"}, "a", "a")
+
+	if err := New("zalo", db, zerolog.Nop()).Upgrade(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkPortals(t, zalo,
+		networkid.PortalKey{ID: "1:0", Receiver: "a"},
+		networkid.PortalKey{ID: "1:0", Receiver: "b"},
+		networkid.PortalKey{ID: "2:0", Receiver: "b"},
+		networkid.PortalKey{ID: "4:1"},
+	)
+	checkPortals(t, other, networkid.PortalKey{ID: "5:0"})
+}
+
+func TestUpgradeDMPortalReceiverSingleLogin(t *testing.T) {
+	db, bridges := newTestBridgeDB(t, "a")
+	zalo := bridges["zalo"]
+	addPortal(t, zalo, networkid.PortalKey{ID: "1:0"}, "")
+	// a already has the chat, so the leftover is dropped
+	addPortal(t, zalo, networkid.PortalKey{ID: "2:0", Receiver: "a"}, "")
+	addPortal(t, zalo, networkid.PortalKey{ID: "2:0"}, "")
+
+	if err := New("zalo", db, zerolog.Nop()).Upgrade(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkPortals(t, zalo,
+		networkid.PortalKey{ID: "1:0", Receiver: "a"},
+		networkid.PortalKey{ID: "2:0", Receiver: "a"},
+	)
+}
@@ -0,0 +1,122 @@
+package zalodb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MediaQuery looks up and stores Zalo media that was already uploaded to Matrix.
+type MediaQuery struct {
+	BridgeID networkid.BridgeID
+	*dbutil.QueryHelper[*Media]
+}
+
+// Media is a Zalo file in the Matrix media repo. Key identifies the file on the Zalo side,
+// e.g. a sticker ID or a CDN path. File is set for media uploaded to encrypted rooms.
+type Media struct {
+	BridgeID  networkid.BridgeID
+	Key       string
+	Encrypted bool
+	MXC       id.ContentURIString
+	File      *event.EncryptedFileInfo
+	MimeType  string
+	Size      int64
+	Width     int
+	Height    int
+	Animated  bool
+	Blurhash  string
+	Hash      [32]byte
+	CreatedAt time.Time
+}
+
+const (
+	getMediaQuery = `
+		SELECT bridge_id, media_key, encrypted, mxc, file, mime_type, size, width, height, animated, blurhash,
+			hash, created_at
+		FROM zalo_media
+		WHERE bridge_id=$1 AND media_key=$2 AND encrypted=$3
+	`
+	getMediaByMXCQuery = `
+		SELECT bridge_id, media_key, encrypted, mxc, file, mime_type, size, width, height, animated, blurhash,
+			hash, created_at
+		FROM zalo_media
+		WHERE bridge_id=$1 AND mxc=$2 AND media_key LIKE $3 || '%'
+		LIMIT 1
+	`
+	putMediaQuery = `
+		INSERT INTO zalo_media (
+			bridge_id, media_key, encrypted, mxc, file, mime_type, size, width, height, animated, blurhash,
+			hash, created_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (bridge_id, media_key, encrypted) DO UPDATE
+			SET mxc=excluded.mxc, file=excluded.file, mime_type=excluded.mime_type, size=excluded.size,
+				width=excluded.width, height=excluded.height, animated=excluded.animated, blurhash=excluded.blurhash,
+				hash=excluded.hash, created_at=excluded.created_at
+	`
+)
+
+func newMediaQuery(bridgeID networkid.BridgeID, db *dbutil.Database) *MediaQuery {
+	return &MediaQuery{
+		BridgeID: bridgeID,
+		QueryHelper: dbutil.MakeQueryHelper(db, func(_ *dbutil.QueryHelper[*Media]) *Media {
+			return &Media{}
+		}),
+	}
+}
+
+// Get returns the cached upload of a file, or nil if it hasn't been uploaded yet.
+func (mq *MediaQuery) Get(ctx context.Context, key string, encrypted bool) (*Media, error) {
+	return mq.QueryOne(ctx, getMediaQuery, mq.BridgeID, key, encrypted)
+}
+
+// GetByMXC returns the cached file that was uploaded as an MXC URI, if its key starts with keyPrefix.
+func (mq *MediaQuery) GetByMXC(ctx context.Context, mxc id.ContentURIString, keyPrefix string) (*Media, error) {
+	return mq.QueryOne(ctx, getMediaByMXCQuery, mq.BridgeID, mxc, keyPrefix)
+}
+
+// Put stores an upload, replacing any earlier one of the same file.
+func (mq *MediaQuery) Put(ctx context.Context, media *Media) error {
+	media.BridgeID = mq.BridgeID
+	if media.CreatedAt.IsZero() {
+		media.CreatedAt = time.Now()
+	}
+	return mq.Exec(ctx, putMediaQuery, media.sqlVariables()...)
+}
+
+func (m *Media) Scan(row dbutil.Scannable) (*Media, error) {
+	var hash sql.NullString
+	var createdAt int64
+	err := row.Scan(
+		&m.BridgeID, &m.Key, &m.Encrypted, &m.MXC, dbutil.JSON{Data: &m.File},
+		&m.MimeType, &m.Size, &m.Width, &m.Height, &m.Animated, &m.Blurhash, &hash, &createdAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if hash.Valid {
+		if data, _ := hex.DecodeString(hash.String); len(data) == len(m.Hash) {
+			m.Hash = [32]byte(data)
+		}
+	}
+	m.CreatedAt = time.UnixMilli(createdAt)
+	return m, nil
+}
+
+func (m *Media) sqlVariables() []any {
+	var hash sql.NullString
+	if m.Hash != [32]byte{} {
+		hash = sql.NullString{String: hex.EncodeToString(m.Hash[:]), Valid: true}
+	}
+	return []any{
+		m.BridgeID, m.Key, m.Encrypted, m.MXC, dbutil.JSONPtr(m.File),
+		m.MimeType, m.Size, m.Width, m.Height, m.Animated, m.Blurhash, hash, m.CreatedAt.UnixMilli(),
+	}
+}
@@ -0,0 +1,68 @@
+package zalodb
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// StickerPackQuery remembers which sticker packs are used in the chats of each login.
+type StickerPackQuery struct {
+	BridgeID networkid.BridgeID
+	*dbutil.QueryHelper[*StickerPack]
+}
+
+// StickerPack is a Zalo sticker pack (sticker category) that a login sent or received a sticker from.
+type StickerPack struct {
+	BridgeID networkid.BridgeID
+	LoginID  networkid.UserLoginID
+	PackID   string
+	LastUsed time.Time
+}
+
+const (
+	getStickerPacksQuery = `
+		SELECT bridge_id, login_id, pack_id, last_used FROM zalo_sticker_pack
+		WHERE bridge_id=$1 AND login_id=$2
+		ORDER BY last_used DESC
+	`
+	putStickerPackQuery = `
+		INSERT INTO zalo_sticker_pack (bridge_id, login_id, pack_id, last_used)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (bridge_id, login_id, pack_id) DO UPDATE
+			SET last_used=excluded.last_used
+			WHERE excluded.last_used > zalo_sticker_pack.last_used
+	`
+)
+
+func newStickerPackQuery(bridgeID networkid.BridgeID, db *dbutil.Database) *StickerPackQuery {
+	return &StickerPackQuery{
+		BridgeID: bridgeID,
+		QueryHelper: dbutil.MakeQueryHelper(db, func(_ *dbutil.QueryHelper[*StickerPack]) *StickerPack {
+			return &StickerPack{}
+		}),
+	}
+}
+
+// GetAll returns the packs used in a login's chats, most recently used first.
+func (spq *StickerPackQuery) GetAll(ctx context.Context, loginID networkid.UserLoginID) ([]*StickerPack, error) {
+	return spq.QueryMany(ctx, getStickerPacksQuery, spq.BridgeID, loginID)
+}
+
+// Put records that a login used a pack at the given time.
+func (spq *StickerPackQuery) Put(ctx context.Context, pack *StickerPack) error {
+	pack.BridgeID = spq.BridgeID
+	return spq.Exec(ctx, putStickerPackQuery, pack.BridgeID, pack.LoginID, pack.PackID, pack.LastUsed.UnixMilli())
+}
+
+func (sp *StickerPack) Scan(row dbutil.Scannable) (*StickerPack, error) {
+	var lastUsed int64
+	err := row.Scan(&sp.BridgeID, &sp.LoginID, &sp.PackID, &lastUsed)
+	if err != nil {
+		return nil, err
+	}
+	sp.LastUsed = time.UnixMilli(lastUsed)
+	return sp, nil
+}
@@ -0,0 +1,15 @@
+-- v2: Cache of Zalo media already uploaded to Matrix
+-- Media uploaded to an encrypted room is only reused in encrypted rooms and vice versa.
+CREATE TABLE zalo_media (
+	bridge_id  TEXT    NOT NULL,
+	media_key  TEXT    NOT NULL,
+	encrypted  BOOLEAN NOT NULL,
+	mxc        TEXT    NOT NULL,
+	file       jsonb,
+	mime_type  TEXT    NOT NULL,
+	size       BIGINT  NOT NULL,
+	hash       TEXT,
+	created_at BIGINT  NOT NULL,
+
+	PRIMARY KEY (bridge_id, media_key, encrypted)
+);
@@ -0,0 +1,3 @@
+-- v3: Index cached media by MXC URI
+-- Lets stickers from imported packs be mapped back to their Zalo sticker IDs.
+CREATE INDEX zalo_media_mxc_idx ON zalo_media (bridge_id, mxc);
@@ -0,0 +1,4 @@
+-- v4: Remember the dimensions of cached images and whether they're animated
+ALTER TABLE zalo_media ADD COLUMN width INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE zalo_media ADD COLUMN height INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE zalo_media ADD COLUMN animated BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,2 @@
+-- v5: Remember the blurhash of cached thumbnails
+ALTER TABLE zalo_media ADD COLUMN blurhash TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,10 @@
+-- v6: Sticker packs used in each login's chats
+-- zca-js can't list the packs an account owns, so the packs of stickers sent and received are remembered instead.
+CREATE TABLE zalo_sticker_pack (
+	bridge_id TEXT   NOT NULL,
+	login_id  TEXT   NOT NULL,
+	pack_id   TEXT   NOT NULL,
+	last_used BIGINT NOT NULL,
+
+	PRIMARY KEY (bridge_id, login_id, pack_id)
+);
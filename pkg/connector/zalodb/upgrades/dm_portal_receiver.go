@@ -0,0 +1,61 @@
+package upgrades
+
+import (
+	"context"
+	"fmt"
+
+	"go.mau.fi/util/dbutil"
+)
+
+// v1 keys DM portals by the receiving user login. DM portal IDs are "<zalo uid>:0". Each one gets the
+// receiver of a login that was in the room and doesn't have its own portal for the same chat yet, the one
+// the user prefers for the room first, then the lowest login ID. Child rows follow via ON UPDATE CASCADE.
+// It touches the bridge's shared tables, so it needs the bridge ID from WithBridgeID.
+const (
+	dmReceiverFromRoomQuery = `
+		UPDATE portal
+		SET receiver=COALESCE((
+			SELECT up.login_id
+			FROM user_portal up
+			WHERE up.bridge_id=portal.bridge_id
+			  AND up.portal_id=portal.id
+			  AND up.portal_receiver=''
+			  AND NOT EXISTS (
+				SELECT 1 FROM portal p2
+				WHERE p2.bridge_id=up.bridge_id AND p2.id=up.portal_id AND p2.receiver=up.login_id
+			  )
+			ORDER BY up.preferred DESC, up.login_id
+			LIMIT 1
+		), '')
+		WHERE bridge_id=$1 AND receiver='' AND id LIKE '%:0'
+	`
+	// DMs nobody was in, or whose logins all have their own portal already, go to the only login if there's one
+	dmReceiverFromOnlyLoginQuery = `
+		UPDATE portal
+		SET receiver=(SELECT id FROM user_login WHERE bridge_id=$1)
+		WHERE bridge_id=$1 AND receiver='' AND id LIKE '%:0'
+		  AND (SELECT COUNT(*) FROM user_login WHERE bridge_id=$1)=1
+		  AND NOT EXISTS (
+			SELECT 1 FROM portal p2
+			WHERE p2.bridge_id=portal.bridge_id AND p2.id=portal.id
+			  AND p2.receiver=(SELECT id FROM user_login WHERE bridge_id=$1)
+		  )
+	`
+	// Anything left can't be reached anymore, as DM portal keys always have a receiver now
+	deleteUnownedDMsQuery = `
+		DELETE FROM portal WHERE bridge_id=$1 AND receiver='' AND id LIKE '%:0'
+	`
+)
+
+func upgradeDMPortalReceiver(ctx context.Context, db *dbutil.Database) error {
+	bridgeID, ok := ctx.Value(bridgeIDContextKey{}).(string)
+	if !ok {
+		return fmt.Errorf("bridge ID missing from upgrade context")
+	}
+	for _, query := range []string{dmReceiverFromRoomQuery, dmReceiverFromOnlyLoginQuery, deleteUnownedDMsQuery} {
+		if _, err := db.Exec(ctx, query, bridgeID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
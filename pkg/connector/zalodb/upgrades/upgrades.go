@@ -0,0 +1,26 @@
+package upgrades
+
+import (
+	"context"
+	"embed"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+var Table dbutil.UpgradeTable
+
+//go:embed *.sql
+var rawUpgrades embed.FS
+
+type bridgeIDContextKey struct{}
+
+// WithBridgeID adds the bridge ID to the context of an upgrade, for upgrades of the bridge's shared tables.
+func WithBridgeID(ctx context.Context, bridgeID networkid.BridgeID) context.Context {
+	return context.WithValue(ctx, bridgeIDContextKey{}, string(bridgeID))
+}
+
+func init() {
+	Table.Register(0, 1, 0, "Key DM portals by the receiving user login", dbutil.TxnModeOn, upgradeDMPortalReceiver)
+	Table.RegisterFS(rawUpgrades)
+}
@@ -2,18 +2,32 @@
 
 import type { BroadcastFn } from "../types.js";
 
+// Event types used for a disbanded group, normalized to "disband" for the bridge
+const DISBAND_EVENT_TYPES = new Set(["disperse", "disperse_group", "disband"]);
+
+function normalizeEventType(event: any): string {
+  const type = String(event.type || event.eventType || event.data?.eventType || "unknown");
+  return DISBAND_EVENT_TYPES.has(type) ? "disband" : type;
+}
+
 export function handleGroupEvent(event: any, broadcast: BroadcastFn): void {
   try {
-    console.log("[GroupHandler] Discovery logging - raw group event:", JSON.stringify(event, null, 2));
-
+    const data = event.data || {};
     const serialized = {
-      eventType: event.eventType || event.type || event.data?.eventType,
-      groupId: event.groupId || event.threadId || event.data?.groupId,
-      actorId: event.actorId || event.senderId || event.data?.actorId,
-      targetId: event.targetId || event.data?.targetId,
-      groupName: event.groupName || event.data?.groupName,
-      timestamp: event.ts || event.timestamp || Date.now(),
-      rawData: event,
+      eventType: normalizeEventType(event),
+      groupId: data.groupId || event.groupId || event.threadId,
+      // The user who performed the change (added/removed someone, renamed the group, ...)
+      actorId: data.sourceId || data.creatorId || event.actorId || event.senderId,
+      // The users the change applies to (joined, left, removed, promoted, ...)
+      members: (data.updateMembers || []).map((m: any) => ({
+        userId: m.id,
+        displayName: m.dName || m.zaloName || "",
+        avatar: m.avatar || "",
+      })),
+      groupName: data.groupName || event.groupName,
+      avatarUrl: data.fullAvt || data.avt,
+      isSelf: event.isSelf || false,
+      timestamp: Number(data.time || event.ts || event.timestamp) || Date.now(),
     };
 
     broadcast({
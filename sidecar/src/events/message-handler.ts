@@ -2,23 +2,85 @@
 
 import type { BroadcastFn } from "../types.js";
 
+// Convert a zca-js message (live or from history) into the JSON shape the bridge expects
+export function serializeMessage(message: any): any {
+  const rawContent = message.content ?? message.data?.content ?? message.message;
+  const attachment = serializeAttachment(rawContent);
+  // Sticker content is just { id, catId, type }, so its image URL is built from the ID
+  const stickerId =
+    message.data?.msgType === "chat.sticker" && rawContent?.id != null ? String(rawContent.id) : undefined;
+  return {
+    msgId: message.msgId || message.messageId || message.data?.msgId,
+    cliMsgId: message.cliMsgId || message.data?.cliMsgId,
+    // Media messages carry an object instead of text; their caption (if any) becomes the content
+    content: typeof rawContent === "string" ? rawContent : attachment?.caption || "",
+    threadId: message.threadId || message.data?.threadId,
+    // zca-js messages carry their thread type (0 = user, 1 = group) in message.type
+    threadType: message.threadType ?? (typeof message.type === "number" ? message.type : message.data?.threadType),
+    senderId: message.senderId || message.uidFrom || message.data?.uidFrom,
+    isSelf: message.isSelf || message.data?.isSelf || false,
+    timestamp: Number(message.ts || message.data?.ts || message.timestamp) || Date.now(),
+    quote: serializeQuote(message.quote || message.data?.quote),
+    mentions: serializeMentions(message.data?.mentions || message.mentions),
+    styles: serializeStyles(message.data?.textProperties ?? message.textProperties),
+    msgType: determineMessageType(message),
+    // Zalo's own message type (e.g. "webchat", "chat.photo"), needed to quote the message later
+    zaloMsgType: message.data?.msgType,
+    mediaUrl: message.url || message.data?.url || attachment?.url || (stickerId && stickerUrl(stickerId)),
+    thumb: message.thumb || message.data?.thumb || attachment?.thumb,
+    width: message.width || message.data?.width || attachment?.width,
+    height: message.height || message.data?.height || attachment?.height,
+    fileName: attachment?.fileName,
+    fileSize: attachment?.fileSize,
+    duration: attachment?.duration,
+    stickerId,
+    stickerPackId: stickerId && rawContent.catId != null ? String(rawContent.catId) : undefined,
+  };
+}
+
+function stickerUrl(stickerId: string): string {
+  return `https://zalo-api.zadn.vn/api/emoticon/sticker/webpc?eid=${encodeURIComponent(stickerId)}&size=130`;
+}
+
+// Zalo media content looks like { title, description, href, thumb, params }, where params
+// is a JSON string with type-specific details such as fileSize, duration and dimensions
+function serializeAttachment(content: any): any {
+  if (!content || typeof content !== "object") return undefined;
+  let params: any = content.params;
+  if (typeof params === "string") {
+    try {
+      params = JSON.parse(params);
+    } catch {
+      params = undefined;
+    }
+  }
+  params = params || {};
+  return {
+    url: content.href || content.url || params.hd || "",
+    thumb: content.thumb || "",
+    fileName: content.title || "",
+    fileSize: Number(params.fileSize) || undefined,
+    duration: Number(params.duration) || undefined,
+    width: Number(params.width || params.video_width) || undefined,
+    height: Number(params.height || params.video_height) || undefined,
+    caption: content.description || "",
+  };
+}
+
+// Zalo's own message types, mapped to the types the bridge converts
+const ZALO_MSG_TYPES: Record<string, string> = {
+  webchat: "text",
+  "chat.photo": "image",
+  "chat.gif": "gif",
+  "chat.sticker": "sticker",
+  "chat.video.msg": "video",
+  "share.file": "file",
+  "chat.voice": "voice",
+};
+
 export function handleMessage(message: any, broadcast: BroadcastFn): void {
   try {
-    const serialized = {
-      msgId: message.msgId || message.messageId || message.data?.msgId,
-      content: message.content || message.data?.content || message.message,
-      threadId: message.threadId || message.data?.threadId,
-      threadType: message.threadType || message.data?.threadType,
-      senderId: message.senderId || message.uidFrom || message.data?.uidFrom,
-      isSelf: message.isSelf || message.data?.isSelf || false,
-      timestamp: message.ts || message.timestamp || Date.now(),
-      quote: message.quote || message.data?.quote,
-      msgType: determineMessageType(message),
-      mediaUrl: message.url || message.data?.url,
-      thumb: message.thumb || message.data?.thumb,
-      width: message.width || message.data?.width,
-      height: message.height || message.data?.height,
-    };
+    const serialized = serializeMessage(message);
 
     broadcast({
       type: "message",
@@ -33,10 +95,55 @@ export function handleMessage(message: any, broadcast: BroadcastFn): void {
   }
 }
 
+// Mention ranges are UTF-16 offsets into content; @All mentions (type 1) use uid "-1"
+function serializeMentions(mentions: any): any[] | undefined {
+  if (!Array.isArray(mentions) || mentions.length === 0) return undefined;
+  return mentions.map((m: any) => ({
+    uid: m.type === 1 ? "-1" : String(m.uid),
+    pos: m.pos,
+    len: m.len,
+  }));
+}
+
+// Style ranges are UTF-16 offsets into content. Zalo sends them as JSON in textProperties,
+// and a single range may carry several comma-separated styles (e.g. "b,c_db342e").
+function serializeStyles(textProperties: any): any[] | undefined {
+  let props = textProperties;
+  if (typeof props === "string") {
+    try {
+      props = JSON.parse(props);
+    } catch {
+      return undefined;
+    }
+  }
+  if (!Array.isArray(props?.styles) || props.styles.length === 0) return undefined;
+  return props.styles.flatMap((s: any) =>
+    String(s.st || "")
+      .split(",")
+      .filter(Boolean)
+      .map((st: string) => ({ start: s.start, len: s.len, st: st.trim() }))
+  );
+}
+
+// zca-js quotes reference the original message by globalMsgId and carry its text in msg
+function serializeQuote(quote: any): any {
+  if (!quote) return undefined;
+  return {
+    msgId: String(quote.globalMsgId ?? quote.msgId ?? ""),
+    cliMsgId: String(quote.cliMsgId ?? ""),
+    senderId: quote.ownerId || quote.uidFrom || "",
+    senderName: quote.fromD || "",
+    content: typeof quote.msg === "string" ? quote.msg : "",
+  };
+}
+
 function determineMessageType(message: any): string {
-  // Check explicit type field
-  if (message.type) return message.type;
-  if (message.data?.type) return message.data.type;
+  const zaloType = message.data?.msgType;
+  if (zaloType && ZALO_MSG_TYPES[zaloType]) return ZALO_MSG_TYPES[zaloType];
+
+  // zca-js uses message.type for the thread type, so only trust string types here
+  if (typeof message.type === "string") return message.type;
+  if (typeof message.data?.type === "string") return message.data.type;
 
   // Infer from content
   if (message.url || message.data?.url) {
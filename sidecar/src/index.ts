@@ -1,7 +1,8 @@
 // Main entry point for mautrix-zalo sidecar
 
-import { ZaloClientWrapper } from "./zalo-client.js";
+import { SessionManager } from "./session-manager.js";
 import { createServer } from "./server.js";
+import type { SessionBroadcastFn } from "./types.js";
 
 async function main() {
   // Read configuration from environment
@@ -11,15 +12,15 @@ async function main() {
   console.log(`[Main] Port: ${port}`);
 
   // Create broadcast function placeholder
-  let broadcastFn = (evt: any) => {
-    console.warn("[Main] Broadcast called before server ready:", evt.type);
+  let broadcastFn: SessionBroadcastFn = (sessionId, evt) => {
+    console.warn(`[Main] Broadcast to ${sessionId} called before server ready:`, evt.type);
   };
 
-  // Create Zalo client with broadcast function
-  const zaloClient = new ZaloClientWrapper((evt) => broadcastFn(evt));
+  // Create session manager; each session gets its own Zalo client
+  const sessions = new SessionManager((sessionId, evt) => broadcastFn(sessionId, evt));
 
   // Create and start server
-  const { app, broadcast } = await createServer(port, zaloClient);
+  const { app, broadcast } = await createServer(port, sessions);
 
   // Update broadcast function reference
   broadcastFn = broadcast;
@@ -31,7 +32,7 @@ async function main() {
     console.log(`[Main] Received ${signal}, shutting down gracefully...`);
 
     try {
-      zaloClient.disconnect();
+      sessions.disconnectAll();
       await app.close();
       console.log("[Main] Shutdown complete");
       process.exit(0);
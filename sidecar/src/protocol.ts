@@ -0,0 +1,76 @@
+// Protocol metadata - reported to the bridge during the WebSocket handshake
+
+import { readFileSync } from "node:fs";
+import { dirname, join } from "node:path";
+import { fileURLToPath } from "node:url";
+
+// Bump whenever the JSON shapes shared with the Go bridge change incompatibly
+export const PROTOCOL_VERSION = 1;
+
+// Optional capabilities; the bridge disables features the sidecar doesn't list
+export const FEATURES = [
+  "send_text",
+  "send_image",
+  "send_sticker",
+  "send_file",
+  "send_video",
+  "send_voice",
+  "reactions",
+  "undo",
+  "group_events",
+  "friends",
+  "groups",
+  "replay",
+  "history",
+  "upload",
+  "stickers",
+  "sticker_packs",
+  "conversations",
+];
+
+export interface HelloPayload {
+  protocolVersion: number;
+  sidecarVersion: string;
+  zcaJsVersion: string;
+  features: string[];
+  // Set in the WebSocket handshake: the epoch of the session's event sequence numbers
+  epoch?: string;
+}
+
+function readPackageVersion(start: string, name: string): string {
+  let dir = start;
+  for (;;) {
+    try {
+      const pkg = JSON.parse(readFileSync(join(dir, "package.json"), "utf8"));
+      if (!name || pkg.name === name) {
+        return pkg.version || "unknown";
+      }
+    } catch {
+      // No package.json here, keep walking up
+    }
+    const parent = dirname(dir);
+    if (parent === dir) return "unknown";
+    dir = parent;
+  }
+}
+
+function resolveZcaJsVersion(): string {
+  try {
+    const entry = fileURLToPath(import.meta.resolve("zca-js"));
+    return readPackageVersion(dirname(entry), "zca-js");
+  } catch (error) {
+    console.warn("[Protocol] Failed to resolve zca-js version:", error);
+    return "unknown";
+  }
+}
+
+const hello: HelloPayload = {
+  protocolVersion: PROTOCOL_VERSION,
+  sidecarVersion: readPackageVersion(dirname(fileURLToPath(import.meta.url)), "sidecar"),
+  zcaJsVersion: resolveZcaJsVersion(),
+  features: FEATURES,
+};
+
+export function getHello(): HelloPayload {
+  return hello;
+}
@@ -1,7 +1,7 @@
 // Group routes - group info endpoints
 
 import type { FastifyInstance } from "fastify";
-import type { ZaloClientWrapper } from "../zalo-client.js";
+import { requireSession, type SessionManager } from "../session-manager.js";
 
 const errorSchema = {
   type: "object" as const,
@@ -13,9 +13,9 @@ const errorSchema = {
 
 export async function groupRoutes(
   app: FastifyInstance,
-  options: { zaloClient: ZaloClientWrapper }
+  options: { sessions: SessionManager }
 ) {
-  const { zaloClient } = options;
+  const { sessions } = options;
 
   // GET /group/:id - Get group info
   app.get<{ Params: { id: string } }>("/group/:id", {
@@ -38,17 +38,35 @@ export async function groupRoutes(
               properties: {
                 groupId: { type: "string" },
                 name: { type: "string" },
-                members: { type: "array", items: { type: "object" } },
+                avatar: { type: "string" },
+                memberIds: { type: "array", items: { type: "string" } },
+                members: {
+                  type: "array",
+                  items: {
+                    type: "object",
+                    properties: {
+                      userId: { type: "string" },
+                      displayName: { type: "string" },
+                      avatar: { type: "string" },
+                    },
+                  },
+                },
+                adminIds: { type: "array", items: { type: "string" } },
+                creatorId: { type: "string" },
               },
             },
           },
         },
         400: errorSchema,
+        404: errorSchema,
         500: errorSchema,
       },
     },
   }, async (request, reply) => {
     try {
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
       const { id } = request.params;
 
       if (!id) {
@@ -94,11 +112,16 @@ export async function groupRoutes(
             },
           },
         },
+        400: errorSchema,
+        404: errorSchema,
         500: errorSchema,
       },
     },
   }, async (request, reply) => {
     try {
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
       console.log("[GroupRoutes] Fetching all groups");
       const groups = await zaloClient.getAllGroups();
       return reply.send({ success: true, groups });
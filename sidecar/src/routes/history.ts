@@ -0,0 +1,126 @@
+// History routes - fetch past messages for backfill
+
+import type { FastifyInstance } from "fastify";
+import { requireSession, type SessionManager } from "../session-manager.js";
+import type { HistoryQuery } from "../types.js";
+
+const errorSchema = {
+  type: "object" as const,
+  properties: {
+    error: { type: "string" as const },
+    code: { type: "string" as const },
+  },
+};
+
+export async function historyRoutes(
+  app: FastifyInstance,
+  options: { sessions: SessionManager }
+) {
+  const { sessions } = options;
+
+  // GET /conversations - Recently active threads, newest first
+  app.get("/conversations", {
+    schema: {
+      tags: ["history"],
+      summary: "List recently active threads with the time of their latest message",
+      response: {
+        200: {
+          type: "object",
+          properties: {
+            success: { type: "boolean" },
+            conversations: {
+              type: "array",
+              items: {
+                type: "object",
+                properties: {
+                  threadId: { type: "string" },
+                  threadType: { type: "number" },
+                  lastMessageTime: { type: "number" },
+                },
+              },
+            },
+          },
+        },
+        404: errorSchema,
+        500: errorSchema,
+      },
+    },
+  }, async (request, reply) => {
+    try {
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
+      const conversations = await zaloClient.getConversations();
+      return reply.send({ success: true, conversations });
+    } catch (error: any) {
+      console.error("[HistoryRoutes] Get conversations error:", error);
+      return reply.code(500).send({
+        error: error.message || "Get conversations failed",
+        code: "GET_CONVERSATIONS_ERROR",
+      });
+    }
+  });
+
+  // GET /history/:threadId - Get messages of a thread, oldest first
+  app.get<{ Params: { threadId: string }; Querystring: HistoryQuery }>("/history/:threadId", {
+    schema: {
+      tags: ["history"],
+      summary: "Get message history of a thread",
+      params: {
+        type: "object",
+        properties: {
+          threadId: { type: "string", description: "Chat thread ID" },
+        },
+      },
+      querystring: {
+        type: "object",
+        properties: {
+          threadType: { type: "number", enum: [0, 1], default: 0, description: "0 = User (default), 1 = Group" },
+          count: { type: "number", default: 50, description: "Maximum number of messages" },
+          before: { type: "number", description: "Only messages older than this timestamp (ms)" },
+          beforeMsgId: { type: "string", description: "ID of the message at `before`, to keep older messages from the same millisecond" },
+          after: { type: "number", description: "Only messages newer than this timestamp (ms), oldest first" },
+          afterMsgId: { type: "string", description: "ID of the message at `after`, to keep newer messages from the same millisecond" },
+        },
+      },
+      response: {
+        200: {
+          type: "object",
+          properties: {
+            success: { type: "boolean" },
+            // Same shape as WebSocket message events
+            messages: { type: "array", items: { type: "object", additionalProperties: true } },
+            hasMore: { type: "boolean" },
+          },
+        },
+        400: errorSchema,
+        404: errorSchema,
+        500: errorSchema,
+      },
+    },
+  }, async (request, reply) => {
+    try {
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
+      const { threadId } = request.params;
+      const { threadType = 0, count = 50, before, beforeMsgId, after, afterMsgId } = request.query;
+
+      console.log(`[HistoryRoutes] Fetching history for ${threadId} (count=${count}, before=${before}, after=${after})`);
+      const { messages, hasMore } = await zaloClient.getHistory(
+        threadId,
+        threadType,
+        count,
+        before ? { timestamp: before, msgId: beforeMsgId } : undefined,
+        after ? { timestamp: after, msgId: afterMsgId } : undefined
+      );
+      return reply.send({ success: true, messages, hasMore });
+    } catch (error: any) {
+      console.error("[HistoryRoutes] Get history error:", error);
+      return reply.code(500).send({
+        error: error.message || "Get history failed",
+        code: "GET_HISTORY_ERROR",
+      });
+    }
+  });
+}
@@ -1,8 +1,8 @@
 // Login routes - authentication endpoints
 
 import type { FastifyInstance } from "fastify";
-import type { ZaloClientWrapper } from "../zalo-client.js";
 import type { CookieLoginRequest } from "../types.js";
+import { requireSessionId, type SessionManager } from "../session-manager.js";
 
 const errorSchema = {
   type: "object" as const,
@@ -14,32 +14,36 @@ const errorSchema = {
 
 export async function loginRoutes(
   app: FastifyInstance,
-  options: { zaloClient: ZaloClientWrapper }
+  options: { sessions: SessionManager }
 ) {
-  const { zaloClient } = options;
+  const { sessions } = options;
 
   // POST /login/qr - Initiate QR login
   app.post("/login/qr", {
     schema: {
       tags: ["login"],
       summary: "Initiate QR code login",
-      description: "Start a QR login flow. Returns QR data to display to the user.",
+      description:
+        "Start a QR login flow. Returns QR data to display to the user. " +
+        "Use a temporary session ID; it is renamed to the Zalo user ID once login completes.",
       response: {
         200: {
           type: "object",
           properties: {
             success: { type: "boolean" },
-            qr: { type: "string", description: "QR code data" },
-            session: { type: "object", description: "Session data" },
+            qrData: { type: "string", description: "QR code data" },
           },
         },
+        400: errorSchema,
         500: errorSchema,
       },
     },
   }, async (request, reply) => {
     try {
-      console.log("[LoginRoutes] QR login requested");
-      const result = await zaloClient.loginQR();
+      const sessionId = requireSessionId(request, reply);
+      if (!sessionId) return reply;
+      console.log(`[LoginRoutes] QR login requested for session ${sessionId}`);
+      const result = await sessions.getOrCreate(sessionId).loginQR();
 
       if (result.error) {
         return reply.code(500).send({
@@ -50,8 +54,7 @@ export async function loginRoutes(
 
       return reply.send({
         success: true,
-        qr: result.qr,
-        session: result.session,
+        qrData: result.qr,
       });
     } catch (error: any) {
       console.error("[LoginRoutes] QR login error:", error);
@@ -62,6 +65,66 @@ export async function loginRoutes(
     }
   });
 
+  // GET /login/wait - Wait for QR scan to complete
+  app.get("/login/wait", {
+    schema: {
+      tags: ["login"],
+      summary: "Wait for QR login",
+      description: "Block until the pending QR login completes and return the session credentials.",
+      response: {
+        200: {
+          type: "object",
+          properties: {
+            success: { type: "boolean" },
+            userId: { type: "string", description: "Logged-in user's Zalo ID" },
+            cookie: { type: "string", description: "Serialized session cookie" },
+            imei: { type: "string", description: "Device IMEI" },
+            userAgent: { type: "string", description: "Browser user agent" },
+          },
+        },
+        400: errorSchema,
+        404: errorSchema,
+        500: errorSchema,
+      },
+    },
+  }, async (request, reply) => {
+    try {
+      const sessionId = requireSessionId(request, reply);
+      if (!sessionId) return reply;
+
+      const zaloClient = sessions.get(sessionId);
+      if (!zaloClient) {
+        return reply.code(404).send({
+          error: `Unknown session: ${sessionId}`,
+          code: "SESSION_NOT_FOUND",
+        });
+      }
+
+      const result = await zaloClient.waitQRLogin();
+      if (result.error || !result.userId) {
+        sessions.remove(sessionId);
+        return reply.code(500).send({
+          error: result.error || "QR login returned no user ID",
+          code: "QR_LOGIN_FAILED",
+        });
+      }
+
+      // From now on the bridge addresses this session by its login ID
+      sessions.rename(sessionId, result.userId);
+
+      return reply.send({
+        success: true,
+        ...result,
+      });
+    } catch (error: any) {
+      console.error("[LoginRoutes] QR wait error:", error);
+      return reply.code(500).send({
+        error: error.message || "QR login wait failed",
+        code: "QR_WAIT_ERROR",
+      });
+    }
+  });
+
   // POST /login/cookie - Restore session with cookie
   app.post<{ Body: CookieLoginRequest }>("/login/cookie", {
     schema: {
@@ -100,7 +163,11 @@ export async function loginRoutes(
         });
       }
 
-      console.log("[LoginRoutes] Cookie login requested");
+      const sessionId = requireSessionId(request, reply);
+      if (!sessionId) return reply;
+      console.log(`[LoginRoutes] Cookie login requested for session ${sessionId}`);
+      const zaloClient = sessions.getOrCreate(sessionId);
+      zaloClient.disconnect();
       const result = await zaloClient.loginCookie(cookie, imei, userAgent);
 
       if (!result.success) {
@@ -128,7 +195,7 @@ export async function loginRoutes(
     schema: {
       tags: ["login"],
       summary: "Logout",
-      description: "Disconnect the current Zalo session.",
+      description: "Disconnect the Zalo session and forget it.",
       response: {
         200: {
           type: "object",
@@ -137,13 +204,16 @@ export async function loginRoutes(
             message: { type: "string" },
           },
         },
+        400: errorSchema,
         500: errorSchema,
       },
     },
   }, async (request, reply) => {
     try {
-      console.log("[LoginRoutes] Logout requested");
-      zaloClient.disconnect();
+      const sessionId = requireSessionId(request, reply);
+      if (!sessionId) return reply;
+      console.log(`[LoginRoutes] Logout requested for session ${sessionId}`);
+      sessions.remove(sessionId);
 
       return reply.send({
         success: true,
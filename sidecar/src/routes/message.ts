@@ -1,10 +1,14 @@
 // Message routes - send messages, reactions, and undo
 
-import type { FastifyInstance } from "fastify";
-import type { ZaloClientWrapper } from "../zalo-client.js";
+import type { FastifyInstance, FastifyRequest } from "fastify";
+import { getSessionId, requireSession, type SessionManager } from "../session-manager.js";
+import { uploads } from "../uploads.js";
 import type {
   SendTextRequest,
   SendImageRequest,
+  SendFileRequest,
+  SendVideoRequest,
+  SendVoiceRequest,
   SendStickerRequest,
   SendReactionRequest,
   UndoMessageRequest,
@@ -23,11 +27,49 @@ const threadFields = {
   threadType: { type: "number" as const, enum: [0, 1], default: 0, description: "0 = User (default), 1 = Group" },
 };
 
+// Mentions and styles of message text and image captions
+const formattingFields = {
+  mentions: {
+    type: "array",
+    description: "Mention ranges in UTF-16 code units; uid -1 mentions everyone",
+    items: {
+      type: "object",
+      required: ["uid", "pos", "len"],
+      properties: {
+        uid: { type: "string" },
+        pos: { type: "number" },
+        len: { type: "number" },
+      },
+    },
+  },
+  styles: {
+    type: "array",
+    description: "Text style ranges in UTF-16 code units, e.g. b, i, u, s, c_ff0000",
+    items: {
+      type: "object",
+      required: ["start", "len", "st"],
+      properties: {
+        start: { type: "number" },
+        len: { type: "number" },
+        st: { type: "string" },
+      },
+    },
+  },
+} as const;
+
+// Media to send always comes from POST /upload of the same session. Taking local paths would let
+// anyone who can reach the sidecar send any file it can read to Zalo.
+function resolveMediaPath(request: FastifyRequest, uploadId?: string): string | undefined {
+  if (!uploadId) return undefined;
+  const sessionId = getSessionId(request);
+  return sessionId ? uploads.resolve(sessionId, uploadId) : undefined;
+}
+
 export async function messageRoutes(
   app: FastifyInstance,
-  options: { zaloClient: ZaloClientWrapper }
+  options: { sessions: SessionManager }
 ) {
-  const { zaloClient } = options;
+  const { sessions } = options;
 
   // POST /send/text - Send text message
   app.post<{ Body: SendTextRequest }>("/send/text", {
@@ -40,7 +82,20 @@ export async function messageRoutes(
         properties: {
           msg: { type: "string", description: "Message content" },
           ...threadFields,
-          quote: { type: "string", description: "Message ID to quote/reply to" },
+          quote: {
+            type: "object",
+            description: "Message to quote/reply to",
+            required: ["msgId", "senderId"],
+            properties: {
+              msgId: { type: "string" },
+              cliMsgId: { type: "string" },
+              senderId: { type: "string", description: "Zalo user ID of the quoted message's sender" },
+              content: { type: "string", description: "Text of the quoted message" },
+              msgType: { type: "string", description: "Zalo message type of the quoted message, e.g. webchat" },
+              ts: { type: "number", description: "Timestamp of the quoted message (ms)" },
+            },
+          },
+          ...formattingFields,
         },
       },
       response: {
@@ -49,15 +104,20 @@ export async function messageRoutes(
           properties: {
             success: { type: "boolean" },
             messageId: { type: "string" },
+            cliMsgId: { type: "string" },
           },
         },
         400: errorSchema,
+        404: errorSchema,
         500: errorSchema,
       },
     },
   }, async (request, reply) => {
     try {
-      const { msg, threadId, threadType = 0, quote } = request.body;
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
+      const { msg, threadId, threadType = 0, quote, mentions, styles } = request.body;
 
       if (!msg || !threadId) {
         return reply.code(400).send({
@@ -67,7 +127,7 @@ export async function messageRoutes(
       }
 
       console.log(`[MessageRoutes] Sending text to ${threadId}`);
-      const result = await zaloClient.sendText(msg, threadId, threadType, quote);
+      const result = await zaloClient.sendText(msg, threadId, threadType, quote, mentions, styles);
 
       if (!result.success) {
         return reply.code(500).send({
@@ -79,6 +139,7 @@ export async function messageRoutes(
       return reply.send({
         success: true,
         messageId: result.messageId,
+        cliMsgId: result.cliMsgId,
       });
     } catch (error: any) {
       console.error("[MessageRoutes] Send text error:", error);
@@ -96,9 +157,13 @@ export async function messageRoutes(
       summary: "Send image",
       body: {
         type: "object",
-        required: ["filePath", "threadId", "threadType"],
+        required: ["uploadId", "threadId", "threadType"],
         properties: {
-          filePath: { type: "string", description: "Local path to image file" },
+          uploadId: { type: "string", description: "ID of the image file from POST /upload" },
+          width: { type: "integer", description: "Image width in pixels, shown before the image loads" },
+          height: { type: "integer", description: "Image height in pixels" },
+          caption: { type: "string", description: "Caption shown below the image" },
+          ...formattingFields,
           ...threadFields,
         },
       },
@@ -108,25 +173,31 @@ export async function messageRoutes(
           properties: {
             success: { type: "boolean" },
             messageId: { type: "string" },
+            cliMsgId: { type: "string" },
           },
         },
         400: errorSchema,
+        404: errorSchema,
         500: errorSchema,
       },
     },
   }, async (request, reply) => {
     try {
-      const { filePath, threadId, threadType } = request.body;
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
+      const { uploadId, threadId, threadType, width, height, caption, mentions, styles } = request.body;
+      const filePath = resolveMediaPath(request, uploadId);
 
       if (!filePath || !threadId || threadType === undefined) {
         return reply.code(400).send({
-          error: "Missing required fields: filePath, threadId, threadType",
+          error: "Missing required fields: uploadId, threadId, threadType",
           code: "INVALID_REQUEST",
         });
       }
 
       console.log(`[MessageRoutes] Sending image to ${threadId}`);
-      const result = await zaloClient.sendImage(filePath, threadId, threadType);
+      const result = await zaloClient.sendImage(filePath, threadId, threadType, width, height, caption, mentions, styles);
 
       if (!result.success) {
         return reply.code(500).send({
@@ -138,6 +209,7 @@ export async function messageRoutes(
       return reply.send({
         success: true,
         messageId: result.messageId,
+        cliMsgId: result.cliMsgId,
       });
     } catch (error: any) {
       console.error("[MessageRoutes] Send image error:", error);
@@ -145,6 +217,218 @@ export async function messageRoutes(
         error: error.message || "Send image failed",
         code: "SEND_IMAGE_ERROR",
       });
+    } finally {
+      void uploads.release(request.body.uploadId);
+    }
+  });
+
+  // POST /send/file - Send file
+  app.post<{ Body: SendFileRequest }>("/send/file", {
+    schema: {
+      tags: ["message"],
+      summary: "Send file",
+      body: {
+        type: "object",
+        required: ["uploadId", "threadId", "threadType"],
+        properties: {
+          uploadId: { type: "string", description: "ID of the file from POST /upload" },
+          ...threadFields,
+        },
+      },
+      response: {
+        200: {
+          type: "object",
+          properties: {
+            success: { type: "boolean" },
+            messageId: { type: "string" },
+            cliMsgId: { type: "string" },
+          },
+        },
+        400: errorSchema,
+        404: errorSchema,
+        500: errorSchema,
+      },
+    },
+  }, async (request, reply) => {
+    try {
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
+      const { uploadId, threadId, threadType } = request.body;
+      const filePath = resolveMediaPath(request, uploadId);
+
+      if (!filePath || !threadId || threadType === undefined) {
+        return reply.code(400).send({
+          error: "Missing required fields: uploadId, threadId, threadType",
+          code: "INVALID_REQUEST",
+        });
+      }
+
+      console.log(`[MessageRoutes] Sending file to ${threadId}`);
+      const result = await zaloClient.sendFile(filePath, threadId, threadType);
+
+      if (!result.success) {
+        return reply.code(500).send({
+          error: result.error,
+          code: "SEND_FILE_FAILED",
+        });
+      }
+
+      return reply.send({
+        success: true,
+        messageId: result.messageId,
+        cliMsgId: result.cliMsgId,
+      });
+    } catch (error: any) {
+      console.error("[MessageRoutes] Send file error:", error);
+      return reply.code(500).send({
+        error: error.message || "Send file failed",
+        code: "SEND_FILE_ERROR",
+      });
+    } finally {
+      void uploads.release(request.body.uploadId);
+    }
+  });
+
+  // POST /send/video - Send video
+  app.post<{ Body: SendVideoRequest }>("/send/video", {
+    schema: {
+      tags: ["message"],
+      summary: "Send video",
+      body: {
+        type: "object",
+        required: ["uploadId", "threadId", "threadType"],
+        properties: {
+          uploadId: { type: "string", description: "ID of the video file from POST /upload" },
+          thumbnailUploadId: { type: "string", description: "ID of the thumbnail image from POST /upload; without a thumbnail the video is sent as a file" },
+          duration: { type: "number", description: "Duration in milliseconds" },
+          width: { type: "number" },
+          height: { type: "number" },
+          ...threadFields,
+        },
+      },
+      response: {
+        200: {
+          type: "object",
+          properties: {
+            success: { type: "boolean" },
+            messageId: { type: "string" },
+            cliMsgId: { type: "string" },
+          },
+        },
+        400: errorSchema,
+        404: errorSchema,
+        500: errorSchema,
+      },
+    },
+  }, async (request, reply) => {
+    try {
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
+      const { uploadId, threadId, threadType, thumbnailUploadId, duration, width, height } = request.body;
+      const filePath = resolveMediaPath(request, uploadId);
+      const thumbnailPath = resolveMediaPath(request, thumbnailUploadId);
+
+      if (!filePath || !threadId || threadType === undefined) {
+        return reply.code(400).send({
+          error: "Missing required fields: uploadId, threadId, threadType",
+          code: "INVALID_REQUEST",
+        });
+      }
+
+      console.log(`[MessageRoutes] Sending video to ${threadId}`);
+      const result = await zaloClient.sendVideo(filePath, threadId, threadType, thumbnailPath, duration, width, height);
+
+      if (!result.success) {
+        return reply.code(500).send({
+          error: result.error,
+          code: "SEND_VIDEO_FAILED",
+        });
+      }
+
+      return reply.send({
+        success: true,
+        messageId: result.messageId,
+        cliMsgId: result.cliMsgId,
+      });
+    } catch (error: any) {
+      console.error("[MessageRoutes] Send video error:", error);
+      return reply.code(500).send({
+        error: error.message || "Send video failed",
+        code: "SEND_VIDEO_ERROR",
+      });
+    } finally {
+      void uploads.release(request.body.uploadId);
+      void uploads.release(request.body.thumbnailUploadId);
+    }
+  });
+
+  // POST /send/voice - Send voice message
+  app.post<{ Body: SendVoiceRequest }>("/send/voice", {
+    schema: {
+      tags: ["message"],
+      summary: "Send voice message",
+      body: {
+        type: "object",
+        required: ["uploadId", "threadId", "threadType"],
+        properties: {
+          uploadId: { type: "string", description: "ID of the audio file from POST /upload" },
+          ...threadFields,
+        },
+      },
+      response: {
+        200: {
+          type: "object",
+          properties: {
+            success: { type: "boolean" },
+            messageId: { type: "string" },
+            cliMsgId: { type: "string" },
+          },
+        },
+        400: errorSchema,
+        404: errorSchema,
+        500: errorSchema,
+      },
+    },
+  }, async (request, reply) => {
+    try {
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
+      const { uploadId, threadId, threadType } = request.body;
+      const filePath = resolveMediaPath(request, uploadId);
+
+      if (!filePath || !threadId || threadType === undefined) {
+        return reply.code(400).send({
+          error: "Missing required fields: uploadId, threadId, threadType",
+          code: "INVALID_REQUEST",
+        });
+      }
+
+      console.log(`[MessageRoutes] Sending voice message to ${threadId}`);
+      const result = await zaloClient.sendVoice(filePath, threadId, threadType);
+
+      if (!result.success) {
+        return reply.code(500).send({
+          error: result.error,
+          code: "SEND_VOICE_FAILED",
+        });
+      }
+
+      return reply.send({
+        success: true,
+        messageId: result.messageId,
+        cliMsgId: result.cliMsgId,
+      });
+    } catch (error: any) {
+      console.error("[MessageRoutes] Send voice message error:", error);
+      return reply.code(500).send({
+        error: error.message || "Send voice message failed",
+        code: "SEND_VOICE_ERROR",
+      });
+    } finally {
+      void uploads.release(request.body.uploadId);
     }
   });
 
@@ -167,14 +451,19 @@ export async function messageRoutes(
           properties: {
             success: { type: "boolean" },
             messageId: { type: "string" },
+            cliMsgId: { type: "string" },
           },
         },
         400: errorSchema,
+        404: errorSchema,
         500: errorSchema,
       },
     },
   }, async (request, reply) => {
     try {
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
       const { stickerId, threadId, threadType } = request.body;
 
       if (!stickerId || !threadId || threadType === undefined) {
@@ -197,6 +486,7 @@ export async function messageRoutes(
       return reply.send({
         success: true,
         messageId: result.messageId,
+        cliMsgId: result.cliMsgId,
       });
     } catch (error: any) {
       console.error("[MessageRoutes] Send sticker error:", error);
@@ -227,11 +517,15 @@ export async function messageRoutes(
           properties: { success: { type: "boolean" } },
         },
         400: errorSchema,
+        404: errorSchema,
         500: errorSchema,
       },
     },
   }, async (request, reply) => {
     try {
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
       const { messageId, emoji, threadId, threadType } = request.body;
 
       if (!messageId || !emoji || !threadId || threadType === undefined) {
@@ -282,11 +576,15 @@ export async function messageRoutes(
           properties: { success: { type: "boolean" } },
         },
         400: errorSchema,
+        404: errorSchema,
         500: errorSchema,
       },
     },
   }, async (request, reply) => {
     try {
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
       const { messageId, threadId, threadType } = request.body;
 
       if (!messageId || !threadId || threadType === undefined) {
@@ -0,0 +1,125 @@
+// Sticker routes - look up Zalo stickers for importing them as Matrix sticker packs
+
+import type { FastifyInstance } from "fastify";
+import { requireSession, type SessionManager } from "../session-manager.js";
+
+const errorSchema = {
+  type: "object" as const,
+  properties: {
+    error: { type: "string" as const },
+    code: { type: "string" as const },
+  },
+};
+
+const stickersSchema = {
+  type: "array" as const,
+  items: {
+    type: "object" as const,
+    properties: {
+      id: { type: "string" as const },
+      packId: { type: "string" as const },
+      type: { type: "number" as const },
+      text: { type: "string" as const },
+      url: { type: "string" as const },
+    },
+  },
+};
+
+export async function stickerRoutes(
+  app: FastifyInstance,
+  options: { sessions: SessionManager }
+) {
+  const { sessions } = options;
+
+  // GET /stickers/search - Find stickers and their packs by keyword
+  app.get<{ Querystring: { keyword: string } }>("/stickers/search", {
+    schema: {
+      tags: ["sticker"],
+      summary: "Search stickers",
+      querystring: {
+        type: "object",
+        required: ["keyword"],
+        properties: {
+          keyword: { type: "string", description: "Search keyword, e.g. a word or an emoji" },
+        },
+      },
+      response: {
+        200: {
+          type: "object",
+          properties: {
+            success: { type: "boolean" },
+            stickers: stickersSchema,
+          },
+        },
+        400: errorSchema,
+        404: errorSchema,
+        500: errorSchema,
+      },
+    },
+  }, async (request, reply) => {
+    try {
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
+      const { keyword } = request.query;
+      if (!keyword) {
+        return reply.code(400).send({
+          error: "Missing keyword",
+          code: "INVALID_REQUEST",
+        });
+      }
+
+      console.log(`[StickerRoutes] Searching stickers for "${keyword}"`);
+      const stickers = await zaloClient.searchStickers(keyword);
+      return reply.send({ success: true, stickers });
+    } catch (error: any) {
+      console.error("[StickerRoutes] Search stickers error:", error);
+      return reply.code(500).send({
+        error: error.message || "Search stickers failed",
+        code: "SEARCH_STICKERS_ERROR",
+      });
+    }
+  });
+
+  // GET /stickers/packs/:packId - All stickers of a pack
+  app.get<{ Params: { packId: string } }>("/stickers/packs/:packId", {
+    schema: {
+      tags: ["sticker"],
+      summary: "Get the stickers of a pack",
+      params: {
+        type: "object",
+        required: ["packId"],
+        properties: {
+          packId: { type: "string", description: "Sticker pack (category) ID" },
+        },
+      },
+      response: {
+        200: {
+          type: "object",
+          properties: {
+            success: { type: "boolean" },
+            stickers: stickersSchema,
+          },
+        },
+        404: errorSchema,
+        500: errorSchema,
+      },
+    },
+  }, async (request, reply) => {
+    try {
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
+      const { packId } = request.params;
+      console.log(`[StickerRoutes] Fetching sticker pack ${packId}`);
+      const stickers = await zaloClient.getStickerPack(packId);
+      return reply.send({ success: true, stickers });
+    } catch (error: any) {
+      console.error("[StickerRoutes] Get sticker pack error:", error);
+      return reply.code(500).send({
+        error: error.message || "Get sticker pack failed",
+        code: "GET_STICKER_PACK_ERROR",
+      });
+    }
+  });
+}
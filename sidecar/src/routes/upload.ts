@@ -0,0 +1,91 @@
+// Upload routes - receive media bytes from the bridge, so it doesn't need a shared filesystem
+
+import type { FastifyInstance } from "fastify";
+import type { Readable } from "node:stream";
+import { requireSession, getSessionId, type SessionManager } from "../session-manager.js";
+import { uploads } from "../uploads.js";
+
+const errorSchema = {
+  type: "object" as const,
+  properties: {
+    error: { type: "string" as const },
+    code: { type: "string" as const },
+  },
+};
+
+export const FILE_NAME_HEADER = "x-file-name";
+export const FILE_TYPE_HEADER = "x-file-type";
+
+export async function uploadRoutes(
+  app: FastifyInstance,
+  options: { sessions: SessionManager }
+) {
+  const { sessions } = options;
+
+  // Hand the raw request stream to the route instead of buffering it (and hitting bodyLimit)
+  app.addContentTypeParser("application/octet-stream", (_request, payload, done) => {
+    done(null, payload);
+  });
+
+  // POST /upload - Store a file for a following /send/* request
+  app.post<{ Body: Readable }>("/upload", {
+    schema: {
+      tags: ["message"],
+      summary: "Upload media to send",
+      description:
+        "Streams the request body (application/octet-stream) to the sidecar's temp dir. " +
+        "Pass the returned uploadId to a /send/* endpoint within 10 minutes. " +
+        `The file name is taken from the URL-encoded ${FILE_NAME_HEADER} header and the MIME type ` +
+        `from ${FILE_TYPE_HEADER}, which is used to add a missing extension.`,
+      response: {
+        200: {
+          type: "object",
+          properties: {
+            uploadId: { type: "string" },
+            size: { type: "number" },
+          },
+        },
+        400: errorSchema,
+        404: errorSchema,
+        500: errorSchema,
+      },
+    },
+  }, async (request, reply) => {
+    try {
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
+      if (!request.body || typeof (request.body as any).pipe !== "function") {
+        return reply.code(400).send({
+          error: "Expected an application/octet-stream body",
+          code: "INVALID_REQUEST",
+        });
+      }
+
+      const rawName = request.headers[FILE_NAME_HEADER];
+      let fileName = "file";
+      if (typeof rawName === "string" && rawName) {
+        try {
+          fileName = decodeURIComponent(rawName);
+        } catch {
+          fileName = rawName;
+        }
+      }
+
+      const fileType = request.headers[FILE_TYPE_HEADER];
+      const result = await uploads.save(
+        getSessionId(request)!,
+        fileName,
+        typeof fileType === "string" ? fileType : undefined,
+        request.body
+      );
+      return reply.send(result);
+    } catch (error: any) {
+      console.error("[UploadRoutes] Upload error:", error);
+      return reply.code(500).send({
+        error: error.message || "Upload failed",
+        code: "UPLOAD_ERROR",
+      });
+    }
+  });
+}
@@ -1,7 +1,7 @@
 // User routes - user info endpoints
 
 import type { FastifyInstance } from "fastify";
-import type { ZaloClientWrapper } from "../zalo-client.js";
+import { requireSession, type SessionManager } from "../session-manager.js";
 
 const errorSchema = {
   type: "object" as const,
@@ -13,9 +13,9 @@ const errorSchema = {
 
 export async function userRoutes(
   app: FastifyInstance,
-  options: { zaloClient: ZaloClientWrapper }
+  options: { sessions: SessionManager }
 ) {
-  const { zaloClient } = options;
+  const { sessions } = options;
 
   // GET /user/:id - Get user info
   app.get<{ Params: { id: string } }>("/user/:id", {
@@ -44,11 +44,15 @@ export async function userRoutes(
           },
         },
         400: errorSchema,
+        404: errorSchema,
         500: errorSchema,
       },
     },
   }, async (request, reply) => {
     try {
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
       const { id } = request.params;
 
       if (!id) {
@@ -99,16 +103,22 @@ export async function userRoutes(
                   userId: { type: "string" },
                   displayName: { type: "string" },
                   avatar: { type: "string" },
+                  lastActionTime: { type: "number" },
                 },
               },
             },
           },
         },
+        400: errorSchema,
+        404: errorSchema,
         500: errorSchema,
       },
     },
   }, async (request, reply) => {
     try {
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
       const { count = 100, page = 1 } = request.query;
       console.log(`[UserRoutes] Fetching friends (count=${count}, page=${page})`);
       const friends = await zaloClient.getAllFriends(count, page);
@@ -143,12 +153,17 @@ export async function userRoutes(
             },
           },
         },
+        400: errorSchema,
         401: errorSchema,
+        404: errorSchema,
         500: errorSchema,
       },
     },
   }, async (request, reply) => {
     try {
+      const zaloClient = requireSession(sessions, request, reply);
+      if (!zaloClient) return reply;
+
       console.log("[UserRoutes] Fetching self info");
       const ownId = await zaloClient.getSelfId();
 
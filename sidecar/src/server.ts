@@ -5,17 +5,21 @@ import websocket from "@fastify/websocket";
 import swagger from "@fastify/swagger";
 import swaggerUi from "@fastify/swagger-ui";
 import type { FastifyInstance } from "fastify";
-import type { ZaloClientWrapper } from "./zalo-client.js";
-import type { BroadcastFn, WsEvent } from "./types.js";
+import type { SessionBroadcastFn, WsClientFrame, WsEvent } from "./types.js";
+import { getSessionId, SESSION_HEADER, type SessionManager } from "./session-manager.js";
+import { getHello } from "./protocol.js";
 import { loginRoutes } from "./routes/login.js";
 import { messageRoutes } from "./routes/message.js";
 import { userRoutes } from "./routes/user.js";
 import { groupRoutes } from "./routes/group.js";
+import { historyRoutes } from "./routes/history.js";
+import { uploadRoutes } from "./routes/upload.js";
+import { stickerRoutes } from "./routes/sticker.js";
 
 export async function createServer(
   port: number,
-  zaloClient: ZaloClientWrapper
-): Promise<{ app: FastifyInstance; broadcast: BroadcastFn }> {
+  sessions: SessionManager
+): Promise<{ app: FastifyInstance; broadcast: SessionBroadcastFn }> {
   const app = Fastify({
     logger: {
       level: "info",
@@ -29,16 +33,20 @@ export async function createServer(
     },
   });
 
-  // WebSocket clients set
-  const wsClients = new Set<any>();
+  // WebSocket clients, keyed by session ID
+  const wsClients = new Map<string, Set<any>>();
+  // Clients that sent their resume frame; live events are held back until then so
+  // replayed events always arrive before newer ones
+  const resumedClients = new WeakSet<any>();
 
-  // Broadcast function to send events to all connected WS clients
-  const broadcast: BroadcastFn = (evt: WsEvent) => {
+  // Broadcast function to send events to the WS clients of one session
+  const broadcast: SessionBroadcastFn = (sessionId: string, evt: WsEvent) => {
     const payload = JSON.stringify(evt);
     let sent = 0;
     let failed = 0;
 
-    for (const client of wsClients) {
+    for (const client of wsClients.get(sessionId) ?? []) {
+      if (!resumedClients.has(client)) continue;
       try {
         if (client.socket.readyState === 1) {
           // OPEN state
@@ -52,7 +60,7 @@ export async function createServer(
     }
 
     if (sent > 0 || failed > 0) {
-      console.log(`[Server] Broadcast ${evt.type}: sent=${sent}, failed=${failed}`);
+      console.log(`[Server] Broadcast ${evt.type} to ${sessionId}: sent=${sent}, failed=${failed}`);
     }
   };
 
@@ -70,6 +78,8 @@ export async function createServer(
         { name: "message", description: "Send messages, reactions, undo" },
         { name: "user", description: "User info" },
         { name: "group", description: "Group info" },
+        { name: "history", description: "Message history" },
+        { name: "sticker", description: "Sticker catalog" },
       ],
     },
   });
@@ -84,31 +94,68 @@ export async function createServer(
   // WebSocket endpoint
   app.register(async function (fastify) {
     fastify.get("/ws", { websocket: true }, (connection, req) => {
-      console.log("[Server] WebSocket client connected");
-      wsClients.add(connection);
+      const sessionId = getSessionId(req);
+      if (!sessionId) {
+        console.warn(`[Server] Rejecting WebSocket client without ${SESSION_HEADER} header`);
+        connection.socket.close(1008, `Missing ${SESSION_HEADER} header`);
+        return;
+      }
+
+      console.log(`[Server] WebSocket client connected for session ${sessionId}`);
+      const clients = wsClients.get(sessionId) ?? new Set<any>();
+      wsClients.set(sessionId, clients);
+      clients.add(connection);
+      const removeClient = () => {
+        clients.delete(connection);
+        if (clients.size === 0 && wsClients.get(sessionId) === clients) {
+          wsClients.delete(sessionId);
+        }
+      };
 
       connection.socket.on("message", (message: Buffer) => {
-        console.log("[Server] WebSocket message received:", message.toString());
+        let frame: WsClientFrame;
+        try {
+          frame = JSON.parse(message.toString());
+        } catch {
+          console.warn("[Server] Ignoring malformed WebSocket message:", message.toString());
+          return;
+        }
+
+        switch (frame.type) {
+          case "resume": {
+            const events = sessions.replay(sessionId, frame.since);
+            console.log(`[Server] Replaying ${events.length} events after ${frame.since} to ${sessionId}`);
+            for (const evt of events) {
+              connection.socket.send(JSON.stringify(evt));
+            }
+            resumedClients.add(connection);
+            break;
+          }
+          case "ack":
+            sessions.ack(sessionId, frame.seq);
+            break;
+          default:
+            console.log("[Server] WebSocket message received:", message.toString());
+        }
       });
 
       connection.socket.on("close", () => {
-        console.log("[Server] WebSocket client disconnected");
-        wsClients.delete(connection);
+        console.log(`[Server] WebSocket client disconnected from session ${sessionId}`);
+        removeClient();
       });
 
       connection.socket.on("error", (error: Error) => {
         console.error("[Server] WebSocket error:", error);
-        wsClients.delete(connection);
+        removeClient();
       });
 
-      // Send welcome message
-      connection.socket.send(
-        JSON.stringify({
-          type: "connection",
-          data: { message: "Connected to mautrix-zalo sidecar" },
-          timestamp: Date.now(),
-        })
-      );
+      // Send welcome message; doubles as the protocol handshake
+      const welcome: WsEvent = {
+        type: "connection",
+        data: { message: "Connected to mautrix-zalo sidecar", ...getHello(), epoch: sessions.getEpoch(sessionId) },
+        timestamp: Date.now(),
+      };
+      connection.socket.send(JSON.stringify(welcome));
     });
   });
 
@@ -124,6 +171,7 @@ export async function createServer(
             status: { type: "string" },
             timestamp: { type: "number" },
             loggedIn: { type: "boolean" },
+            sessions: { type: "number" },
           },
         },
       },
@@ -132,15 +180,40 @@ export async function createServer(
     return reply.send({
       status: "ok",
       timestamp: Date.now(),
-      loggedIn: zaloClient.isLoggedIn(),
+      loggedIn: sessions.anyLoggedIn(),
+      sessions: sessions.size(),
     });
   });
 
+  // Protocol version and capabilities
+  app.get("/version", {
+    schema: {
+      tags: ["health"],
+      summary: "Protocol version and supported features",
+      response: {
+        200: {
+          type: "object",
+          properties: {
+            protocolVersion: { type: "number" },
+            sidecarVersion: { type: "string" },
+            zcaJsVersion: { type: "string" },
+            features: { type: "array", items: { type: "string" } },
+          },
+        },
+      },
+    },
+  }, async (request, reply) => {
+    return reply.send(getHello());
+  });
+
   // Register route modules
-  await app.register(loginRoutes, { zaloClient });
-  await app.register(messageRoutes, { zaloClient });
-  await app.register(userRoutes, { zaloClient });
-  await app.register(groupRoutes, { zaloClient });
+  await app.register(loginRoutes, { sessions });
+  await app.register(messageRoutes, { sessions });
+  await app.register(userRoutes, { sessions });
+  await app.register(groupRoutes, { sessions });
+  await app.register(historyRoutes, { sessions });
+  await app.register(uploadRoutes, { sessions });
+  await app.register(stickerRoutes, { sessions });
 
   // Start server
   try {
@@ -0,0 +1,169 @@
+// Session manager - one zca-js client per bridge login
+
+import { randomUUID } from "node:crypto";
+import type { FastifyReply, FastifyRequest } from "fastify";
+import { ZaloClientWrapper } from "./zalo-client.js";
+import type { SessionBroadcastFn, WsEvent } from "./types.js";
+
+// Header carrying the session ID (the bridge's UserLoginID) on HTTP and WebSocket requests
+export const SESSION_HEADER = "x-zalo-session";
+
+// Maximum number of unacknowledged events kept per session for replay
+const REPLAY_BUFFER_SIZE = 1000;
+
+interface Session {
+  id: string;
+  client: ZaloClientWrapper;
+  // Identifies this session's sequence numbers; changes whenever the session is recreated
+  epoch: string;
+  seq: number;
+  // Events not yet acknowledged by the bridge, oldest first
+  pending: WsEvent[];
+}
+
+export class SessionManager {
+  private sessions = new Map<string, Session>();
+  private broadcast: SessionBroadcastFn;
+
+  constructor(broadcast: SessionBroadcastFn) {
+    this.broadcast = broadcast;
+  }
+
+  get(sessionId: string): ZaloClientWrapper | undefined {
+    return this.sessions.get(sessionId)?.client;
+  }
+
+  getOrCreate(sessionId: string): ZaloClientWrapper {
+    const existing = this.sessions.get(sessionId);
+    if (existing) {
+      return existing.client;
+    }
+
+    // The broadcast closure reads session.id so events follow the session across renames
+    const session: Session = {
+      id: sessionId,
+      client: new ZaloClientWrapper((evt) => this.publish(session, evt)),
+      epoch: randomUUID(),
+      seq: 0,
+      pending: [],
+    };
+    this.sessions.set(sessionId, session);
+    console.log(`[SessionManager] Created session ${sessionId}`);
+    return session.client;
+  }
+
+  // Assign the next sequence number, keep the event for replay and send it to live clients
+  private publish(session: Session, evt: WsEvent): void {
+    const sequenced: WsEvent = { ...evt, seq: ++session.seq };
+    session.pending.push(sequenced);
+    if (session.pending.length > REPLAY_BUFFER_SIZE) {
+      const dropped = session.pending.shift()!;
+      console.warn(`[SessionManager] Replay buffer full for ${session.id}, dropped event ${dropped.seq}`);
+    }
+    this.broadcast(session.id, sequenced);
+  }
+
+  getEpoch(sessionId: string): string | undefined {
+    return this.sessions.get(sessionId)?.epoch;
+  }
+
+  // Forget events the bridge has durably processed
+  ack(sessionId: string, seq: number): void {
+    const session = this.sessions.get(sessionId);
+    if (!session) return;
+    const idx = session.pending.findIndex((evt) => evt.seq! > seq);
+    session.pending.splice(0, idx === -1 ? session.pending.length : idx);
+  }
+
+  // Events after the given cursor that the bridge hasn't acknowledged yet
+  replay(sessionId: string, since: number): WsEvent[] {
+    const session = this.sessions.get(sessionId);
+    if (!session) return [];
+    return session.pending.filter((evt) => evt.seq! > since);
+  }
+
+  // Re-key a session, e.g. from a temporary login ID to the Zalo user ID after QR login
+  rename(oldId: string, newId: string): void {
+    if (oldId === newId) return;
+    const session = this.sessions.get(oldId);
+    if (!session) return;
+
+    const replaced = this.sessions.get(newId);
+    if (replaced) {
+      console.log(`[SessionManager] Replacing existing session ${newId}`);
+      replaced.client.disconnect();
+    }
+
+    this.sessions.delete(oldId);
+    session.id = newId;
+    this.sessions.set(newId, session);
+    console.log(`[SessionManager] Renamed session ${oldId} -> ${newId}`);
+  }
+
+  remove(sessionId: string): void {
+    const session = this.sessions.get(sessionId);
+    if (!session) return;
+    session.client.disconnect();
+    this.sessions.delete(sessionId);
+    console.log(`[SessionManager] Removed session ${sessionId}`);
+  }
+
+  disconnectAll(): void {
+    for (const session of this.sessions.values()) {
+      session.client.disconnect();
+    }
+    this.sessions.clear();
+  }
+
+  size(): number {
+    return this.sessions.size;
+  }
+
+  anyLoggedIn(): boolean {
+    for (const session of this.sessions.values()) {
+      if (session.client.isLoggedIn()) return true;
+    }
+    return false;
+  }
+}
+
+export function getSessionId(request: FastifyRequest): string | undefined {
+  const value = request.headers[SESSION_HEADER];
+  const sessionId = Array.isArray(value) ? value[0] : value;
+  return sessionId || undefined;
+}
+
+// Read the session ID from a request, sending a 400 response if it's missing
+export function requireSessionId(request: FastifyRequest, reply: FastifyReply): string | null {
+  const sessionId = getSessionId(request);
+  if (!sessionId) {
+    reply.code(400).send({
+      error: `Missing ${SESSION_HEADER} header`,
+      code: "MISSING_SESSION",
+    });
+    return null;
+  }
+  return sessionId;
+}
+
+// Resolve the session for a request, sending an error response if it's missing or unknown
+export function requireSession(
+  sessions: SessionManager,
+  request: FastifyRequest,
+  reply: FastifyReply
+): ZaloClientWrapper | null {
+  const sessionId = requireSessionId(request, reply);
+  if (!sessionId) {
+    return null;
+  }
+
+  const client = sessions.get(sessionId);
+  if (!client) {
+    reply.code(404).send({
+      error: `Unknown session: ${sessionId}`,
+      code: "SESSION_NOT_FOUND",
+    });
+    return null;
+  }
+  return client;
+}
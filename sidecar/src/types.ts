@@ -1,11 +1,18 @@
 // Core type definitions for mautrix-zalo sidecar
 
 export interface WsEvent {
-  type: "message" | "reaction" | "undo" | "group_event";
+  type: "connection" | "message" | "reaction" | "undo" | "group_event";
   data: unknown;
   timestamp: number;
+  // Per-session sequence number, assigned by the session manager
+  seq?: number;
 }
 
+// Control frames sent by the bridge over the WebSocket
+export type WsClientFrame =
+  | { type: "resume"; since: number }
+  | { type: "ack"; seq: number };
+
 export enum ThreadType {
   User = 0,
   Group = 1,
@@ -24,10 +31,20 @@ export interface ErrorResponse {
 
 export type BroadcastFn = (evt: WsEvent) => void;
 
+// Server-side broadcast, routed to the WebSocket clients of a single session
+export type SessionBroadcastFn = (sessionId: string, evt: WsEvent) => void;
+
 // Login request/response types
 export interface QRLoginResponse {
   qr?: string;
-  session?: any;
+  error?: string;
+}
+
+export interface QRLoginResult {
+  userId?: string;
+  cookie?: string;
+  imei?: string;
+  userAgent?: string;
   error?: string;
 }
 
@@ -44,15 +61,72 @@ export interface CookieLoginResponse {
 }
 
 // Message request types
+// The message being replied to, as stored by the bridge
+export interface QuoteRequest {
+  msgId: string;
+  cliMsgId?: string;
+  senderId: string;
+  content?: string;
+  msgType?: string;
+  ts?: number;
+}
+
+// A mention range in UTF-16 code units; uid "-1" mentions everyone (@All)
+export interface Mention {
+  uid: string;
+  pos: number;
+  len: number;
+}
+
+// A text style range in UTF-16 code units; st is a Zalo style code such as "b", "i" or "c_ff0000"
+export interface TextStyle {
+  start: number;
+  len: number;
+  st: string;
+}
+
 export interface SendTextRequest {
   msg: string;
   threadId: string;
   threadType?: ThreadType;
-  quote?: string;
+  quote?: QuoteRequest;
+  mentions?: Mention[];
+  styles?: TextStyle[];
 }
 
 export interface SendImageRequest {
-  filePath: string;
+  // ID from POST /upload
+  uploadId: string;
+  // Dimensions shown by Zalo before the image loads
+  width?: number;
+  height?: number;
+  // Caption, with mention and style ranges in it
+  caption?: string;
+  mentions?: Mention[];
+  styles?: TextStyle[];
+  threadId: string;
+  threadType: ThreadType;
+}
+
+export interface SendFileRequest {
+  uploadId: string;
+  threadId: string;
+  threadType: ThreadType;
+}
+
+export interface SendVideoRequest {
+  uploadId: string;
+  // Thumbnail image; without one the video is sent as a file
+  thumbnailUploadId?: string;
+  duration?: number;
+  width?: number;
+  height?: number;
+  threadId: string;
+  threadType: ThreadType;
+}
+
+export interface SendVoiceRequest {
+  uploadId: string;
   threadId: string;
   threadType: ThreadType;
 }
@@ -76,10 +150,28 @@ export interface UndoMessageRequest {
   threadType: ThreadType;
 }
 
+// History request types
+export interface HistoryQuery {
+  threadType?: ThreadType;
+  count?: number;
+  before?: number;
+  beforeMsgId?: string;
+  after?: number;
+  afterMsgId?: string;
+}
+
+// A position in a thread's history: a timestamp (ms) and, if known, the msgId of the message at it
+export interface HistoryCursor {
+  timestamp: number;
+  msgId?: string;
+}
+
 // Response types
 export interface SendMessageResponse {
   success: boolean;
   messageId?: string;
+  // Zalo's client message ID, which quoting the message needs
+  cliMsgId?: string;
   error?: string;
 }
 
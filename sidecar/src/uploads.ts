@@ -0,0 +1,90 @@
+// Upload store - media streamed from the bridge over HTTP, held on disk until a send request uses it
+
+import { randomUUID } from "node:crypto";
+import { createWriteStream } from "node:fs";
+import { mkdtemp, rm, stat } from "node:fs/promises";
+import { tmpdir } from "node:os";
+import { basename, extname, join } from "node:path";
+import type { Readable } from "node:stream";
+import { pipeline } from "node:stream/promises";
+
+// Uploads that no send request used within this time are deleted
+const UPLOAD_TTL_MS = 10 * 60 * 1000;
+
+interface Upload {
+  sessionId: string;
+  dir: string;
+  path: string;
+  timer: NodeJS.Timeout;
+}
+
+// Zalo shows the name of sent files, so keep the original name but never let it escape the upload dir
+function safeFileName(fileName: string): string {
+  const name = basename(fileName.replace(/\\/g, "/")).replace(/[\x00-\x1f]/g, "").trim();
+  return name && name !== "." && name !== ".." ? name : "file";
+}
+
+// zca-js picks how to send a file by its extension, so names without one get one from the MIME type
+const EXTENSIONS: Record<string, string> = {
+  "image/jpeg": ".jpg",
+  "image/png": ".png",
+  "image/gif": ".gif",
+  "image/webp": ".webp",
+  "video/mp4": ".mp4",
+  "video/quicktime": ".mov",
+  "video/webm": ".webm",
+  "audio/mp4": ".m4a",
+  "audio/aac": ".aac",
+  "audio/mpeg": ".mp3",
+  "audio/ogg": ".ogg",
+  "application/pdf": ".pdf",
+};
+
+function withExtension(fileName: string, mimeType?: string): string {
+  if (extname(fileName) || !mimeType) return fileName;
+  return fileName + (EXTENSIONS[mimeType.split(";")[0].trim().toLowerCase()] ?? "");
+}
+
+export class UploadStore {
+  private uploads = new Map<string, Upload>();
+
+  async save(
+    sessionId: string,
+    fileName: string,
+    mimeType: string | undefined,
+    body: Readable
+  ): Promise<{ uploadId: string; size: number }> {
+    const dir = await mkdtemp(join(tmpdir(), "mautrix-zalo-upload-"));
+    const path = join(dir, withExtension(safeFileName(fileName), mimeType));
+    try {
+      await pipeline(body, createWriteStream(path));
+    } catch (error) {
+      await rm(dir, { recursive: true, force: true });
+      throw error;
+    }
+
+    const uploadId = randomUUID();
+    const timer = setTimeout(() => void this.release(uploadId), UPLOAD_TTL_MS);
+    timer.unref();
+    this.uploads.set(uploadId, { sessionId, dir, path, timer });
+    const { size } = await stat(path);
+    console.log(`[Uploads] Stored upload ${uploadId} (${size} bytes) for ${sessionId}`);
+    return { uploadId, size };
+  }
+
+  // Local path of an upload, only for the session that uploaded it
+  resolve(sessionId: string, uploadId: string): string | undefined {
+    const upload = this.uploads.get(uploadId);
+    return upload && upload.sessionId === sessionId ? upload.path : undefined;
+  }
+
+  async release(uploadId: string | undefined): Promise<void> {
+    const upload = uploadId ? this.uploads.get(uploadId) : undefined;
+    if (!upload) return;
+    this.uploads.delete(uploadId!);
+    clearTimeout(upload.timer);
+    await rm(upload.dir, { recursive: true, force: true });
+  }
+}
+
+export const uploads = new UploadStore();
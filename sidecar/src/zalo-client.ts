@@ -1,12 +1,66 @@
 // Zalo client wrapper - manages Zalo API interactions
 
+import { stat } from "node:fs/promises";
 import { Zalo, API } from "zca-js";
-import type { LoginState, BroadcastFn, ThreadType } from "./types.js";
-import { handleMessage } from "./events/message-handler.js";
+import type {
+  LoginState,
+  BroadcastFn,
+  ThreadType,
+  QRLoginResponse,
+  QRLoginResult,
+  QuoteRequest,
+  Mention,
+  TextStyle,
+  HistoryCursor,
+  SendMessageResponse,
+} from "./types.js";
+import { handleMessage, serializeMessage } from "./events/message-handler.js";
 import { handleReaction } from "./events/reaction-handler.js";
 import { handleUndo } from "./events/undo-handler.js";
 import { handleGroupEvent } from "./events/group-handler.js";
 
+// Upper bound on messages scanned for a single history request
+const HISTORY_SCAN_LIMIT = 500;
+// How long to wait for the listener to answer an old messages request
+const OLD_MESSAGES_TIMEOUT = 15_000;
+// How long a send waits for the echo of the sent message, which carries its client message ID
+const SELF_ECHO_TIMEOUT = 1_500;
+// How many client message IDs of echoes that arrived before their send finished are kept
+const SELF_ECHO_LIMIT = 200;
+
+// Order history messages by timestamp, then by msgId, which Zalo assigns in increasing order.
+// That tells apart messages sent in the same millisecond.
+function compareMessages(a: HistoryCursor, b: HistoryCursor): number {
+  if (a.timestamp !== b.timestamp) return a.timestamp - b.timestamp;
+  const aId = a.msgId ?? "";
+  const bId = b.msgId ?? "";
+  if (aId.length !== bId.length) return aId.length - bId.length;
+  return aId < bId ? -1 : aId > bId ? 1 : 0;
+}
+
+// Cursors without a msgId only compare timestamps, so messages from the cursor's millisecond are excluded
+function isBefore(a: HistoryCursor, b: HistoryCursor): boolean {
+  if (!a.msgId || !b.msgId) return a.timestamp < b.timestamp;
+  return compareMessages(a, b) < 0;
+}
+
+// zca-js returns { message: { msgId }, attachment: [...] } from sendMessage
+function sentMessageId(result: any): string | undefined {
+  const msgId = result?.message?.msgId ?? result?.attachment?.[0]?.msgId ?? result?.msgId;
+  return msgId === undefined || msgId === null ? undefined : String(msgId);
+}
+
+// Convert zca-js sticker details into the shape the bridge expects
+function serializeSticker(sticker: any): any {
+  return {
+    id: String(sticker.id),
+    packId: String(sticker.cateId),
+    type: sticker.type,
+    text: sticker.text || "",
+    url: sticker.stickerWebpUrl || sticker.stickerUrl || "",
+  };
+}
+
 export class ZaloClientWrapper {
   private zalo: Zalo | null = null;
   private state: LoginState = {
@@ -15,29 +69,81 @@ export class ZaloClientWrapper {
     ownId: null,
   };
   private broadcast: BroadcastFn;
+  private pendingQRLogin: Promise<QRLoginResult> | null = null;
+  // Client message IDs of the session's own messages by msgId, from echoes nobody waited for yet
+  private selfCliMsgIds = new Map<string, string>();
+  private selfEchoWaiters = new Map<string, (cliMsgId: string) => void>();
+  // Tail of the queue of old messages requests, see requestOldMessages
+  private oldMessagesQueue: Promise<unknown> = Promise.resolve();
+  // Dimensions of images being sent, by file path, for zca-js to put in the message
+  private imageMetadata = new Map<string, { width: number; height: number; size: number }>();
 
   constructor(broadcast: BroadcastFn) {
     this.broadcast = broadcast;
   }
 
-  async loginQR(): Promise<{ qr?: string; session?: any; error?: string }> {
-    try {
-      console.log("[ZaloClient] Initiating QR login...");
-      this.zalo = new Zalo();
-
-      const api = await this.zalo.loginQR();
-      this.state.api = api;
-      this.state.loggedIn = true;
-      this.state.ownId = await api.getOwnId();
+  // zca-js asks for the dimensions of images it sends; the bridge passes them along with each image
+  private createZalo(): Zalo {
+    return new Zalo({
+      // Echoes of sent messages carry their client message ID, see sentIds
+      selfListen: true,
+      imageMetadataGetter: async (filePath: string) => this.imageMetadata.get(filePath) ?? null,
+    });
+  }
 
-      this.setupListeners(this.broadcast);
+  async loginQR(): Promise<QRLoginResponse> {
+    console.log("[ZaloClient] Initiating QR login...");
+    this.zalo = this.createZalo();
+    let credentials: { cookie: any; imei: string; userAgent: string } | null = null;
+
+    // Resolve as soon as the QR code is ready; the rest of the login is awaited by waitQRLogin
+    return new Promise((resolve) => {
+      this.pendingQRLogin = this.zalo!.loginQR({}, (event: any) => {
+        switch (event.type) {
+          case 0: // QRCodeGenerated
+            resolve({ qr: event.data.code });
+            break;
+          case 1: // QRCodeExpired
+            console.warn("[ZaloClient] QR code expired");
+            event.actions?.abort();
+            break;
+          case 4: // GotLoginInfo
+            credentials = event.data;
+            break;
+        }
+      }).then(async (api): Promise<QRLoginResult> => {
+        if (!credentials) {
+          throw new Error("QR login finished without credentials");
+        }
+        this.state.api = api;
+        this.state.loggedIn = true;
+        this.state.ownId = await api.getOwnId();
+
+        this.setupListeners(this.broadcast);
+
+        console.log(`[ZaloClient] QR login successful, ownId: ${this.state.ownId}`);
+        return {
+          userId: this.state.ownId || undefined,
+          cookie: JSON.stringify(credentials.cookie),
+          imei: credentials.imei,
+          userAgent: credentials.userAgent,
+        };
+      }).catch((error: any) => {
+        console.error("[ZaloClient] QR login failed:", error);
+        const result = { error: error.message || "QR login failed" };
+        resolve(result);
+        return result;
+      });
+    });
+  }
 
-      console.log(`[ZaloClient] QR login successful, ownId: ${this.state.ownId}`);
-      return { session: { ownId: this.state.ownId } };
-    } catch (error: any) {
-      console.error("[ZaloClient] QR login failed:", error);
-      return { error: error.message || "QR login failed" };
+  async waitQRLogin(): Promise<QRLoginResult> {
+    if (!this.pendingQRLogin) {
+      return { error: "No QR login in progress" };
     }
+    const result = await this.pendingQRLogin;
+    this.pendingQRLogin = null;
+    return result;
   }
 
   async loginCookie(
@@ -47,7 +153,7 @@ export class ZaloClientWrapper {
   ): Promise<{ success: boolean; ownId?: string; error?: string }> {
     try {
       console.log("[ZaloClient] Initiating cookie login...");
-      this.zalo = new Zalo();
+      this.zalo = this.createZalo();
 
       // Parse cookie string to cookie array
       const cookies = JSON.parse(cookie);
@@ -76,8 +182,10 @@ export class ZaloClientWrapper {
     msg: string,
     threadId: string,
     threadType: ThreadType,
-    quote?: string
-  ): Promise<{ success: boolean; messageId?: string; error?: string }> {
+    quote?: QuoteRequest,
+    mentions?: Mention[],
+    styles?: TextStyle[]
+  ): Promise<SendMessageResponse> {
     if (!this.state.loggedIn || !this.state.api) {
       return { success: false, error: "Not logged in" };
     }
@@ -86,14 +194,28 @@ export class ZaloClientWrapper {
       const result = await this.state.api.sendMessage(
         {
           msg,
-          quote: quote || undefined,
+          mentions: mentions?.length ? mentions : undefined,
+          styles: styles?.length ? styles : undefined,
+          // zca-js expects the quoted message's own data, as received from the listener
+          quote: quote
+            ? {
+                content: quote.content || "",
+                msgType: quote.msgType || "webchat",
+                propertyExt: undefined,
+                uidFrom: quote.senderId,
+                msgId: quote.msgId,
+                cliMsgId: quote.cliMsgId || "",
+                ts: String(quote.ts || 0),
+                ttl: 0,
+              }
+            : undefined,
         },
         threadId,
         threadType
       );
 
       console.log(`[ZaloClient] Sent text message to ${threadId}`);
-      return { success: true, messageId: result?.msgId };
+      return { success: true, ...(await this.sentIds(sentMessageId(result))) };
     } catch (error: any) {
       console.error("[ZaloClient] Send text failed:", error);
       return { success: false, error: error.message || "Send text failed" };
@@ -103,50 +225,157 @@ export class ZaloClientWrapper {
   async sendImage(
     filePath: string,
     threadId: string,
-    threadType: ThreadType
-  ): Promise<{ success: boolean; messageId?: string; error?: string }> {
+    threadType: ThreadType,
+    width?: number,
+    height?: number,
+    caption?: string,
+    mentions?: Mention[],
+    styles?: TextStyle[]
+  ): Promise<SendMessageResponse> {
     if (!this.state.loggedIn || !this.state.api) {
       return { success: false, error: "Not logged in" };
     }
 
     try {
+      if (width && height) {
+        const { size } = await stat(filePath);
+        this.imageMetadata.set(filePath, { width, height, size });
+      }
+      // zca-js puts the text in the image's caption, except for formats it sends as files (like GIF),
+      // where the text goes in a separate message
       const result = await this.state.api.sendMessage(
         {
-          file: filePath,
+          msg: caption || "",
+          mentions: mentions?.length ? mentions : undefined,
+          styles: styles?.length ? styles : undefined,
+          attachments: [filePath],
         },
         threadId,
         threadType
       );
 
       console.log(`[ZaloClient] Sent image to ${threadId}`);
-      return { success: true, messageId: result?.msgId };
+      // The image is the bridged message even if the caption was sent separately
+      const imageId = result?.attachment?.[0]?.msgId;
+      return { success: true, ...(await this.sentIds(imageId != null ? String(imageId) : sentMessageId(result))) };
     } catch (error: any) {
       console.error("[ZaloClient] Send image failed:", error);
       return { success: false, error: error.message || "Send image failed" };
+    } finally {
+      this.imageMetadata.delete(filePath);
     }
   }
 
-  async sendSticker(
-    stickerId: string,
+  async sendFile(
+    filePath: string,
     threadId: string,
     threadType: ThreadType
-  ): Promise<{ success: boolean; messageId?: string; error?: string }> {
+  ): Promise<SendMessageResponse> {
     if (!this.state.loggedIn || !this.state.api) {
       return { success: false, error: "Not logged in" };
     }
 
     try {
-      // Fetch sticker and send
+      // Zalo shows the file under its name on disk, so the bridge names the file accordingly
       const result = await this.state.api.sendMessage(
         {
-          sticker: stickerId,
+          msg: "",
+          attachments: [filePath],
+        },
+        threadId,
+        threadType
+      );
+
+      console.log(`[ZaloClient] Sent file to ${threadId}`);
+      return { success: true, ...(await this.sentIds(sentMessageId(result))) };
+    } catch (error: any) {
+      console.error("[ZaloClient] Send file failed:", error);
+      return { success: false, error: error.message || "Send file failed" };
+    }
+  }
+
+  async sendVideo(
+    filePath: string,
+    threadId: string,
+    threadType: ThreadType,
+    thumbnailPath?: string,
+    duration?: number,
+    width?: number,
+    height?: number
+  ): Promise<SendMessageResponse> {
+    if (!this.state.loggedIn || !this.state.api) {
+      return { success: false, error: "Not logged in" };
+    }
+    // Zalo video messages need a thumbnail, so send anything without one as a plain file
+    if (!thumbnailPath) {
+      return this.sendFile(filePath, threadId, threadType);
+    }
+
+    try {
+      // Video messages reference uploaded URLs rather than local files
+      const [video] = await this.state.api.uploadAttachment([filePath], threadId, threadType);
+      const [thumbnail] = await this.state.api.uploadAttachment([thumbnailPath], threadId, threadType);
+      const result = await this.state.api.sendVideo(
+        {
+          videoUrl: video.fileUrl,
+          thumbnailUrl: thumbnail.normalUrl || thumbnail.hdUrl,
+          duration,
+          width,
+          height,
         },
         threadId,
         threadType
       );
 
+      console.log(`[ZaloClient] Sent video to ${threadId}`);
+      return { success: true, ...(await this.sentIds(sentMessageId(result))) };
+    } catch (error: any) {
+      console.error("[ZaloClient] Send video failed:", error);
+      return { success: false, error: error.message || "Send video failed" };
+    }
+  }
+
+  async sendVoice(
+    filePath: string,
+    threadId: string,
+    threadType: ThreadType
+  ): Promise<SendMessageResponse> {
+    if (!this.state.loggedIn || !this.state.api) {
+      return { success: false, error: "Not logged in" };
+    }
+
+    try {
+      // Voice messages reference an uploaded URL rather than a local file
+      const [voice] = await this.state.api.uploadAttachment([filePath], threadId, threadType);
+      const result = await this.state.api.sendVoice({ voiceUrl: voice.fileUrl }, threadId, threadType);
+
+      console.log(`[ZaloClient] Sent voice message to ${threadId}`);
+      return { success: true, ...(await this.sentIds(sentMessageId(result))) };
+    } catch (error: any) {
+      console.error("[ZaloClient] Send voice failed:", error);
+      return { success: false, error: error.message || "Send voice failed" };
+    }
+  }
+
+  async sendSticker(
+    stickerId: string,
+    threadId: string,
+    threadType: ThreadType
+  ): Promise<SendMessageResponse> {
+    if (!this.state.loggedIn || !this.state.api) {
+      return { success: false, error: "Not logged in" };
+    }
+
+    try {
+      // zca-js needs the sticker's category and type too, which come with its details
+      const [sticker] = await this.state.api.getStickersDetail(Number(stickerId));
+      if (!sticker) {
+        return { success: false, error: `Unknown sticker ${stickerId}` };
+      }
+      const result = await this.state.api.sendSticker(sticker, threadId, threadType);
+
       console.log(`[ZaloClient] Sent sticker ${stickerId} to ${threadId}`);
-      return { success: true, messageId: result?.msgId };
+      return { success: true, ...(await this.sentIds(sentMessageId(result))) };
     } catch (error: any) {
       console.error("[ZaloClient] Send sticker failed:", error);
       return { success: false, error: error.message || "Send sticker failed" };
@@ -192,6 +421,48 @@ export class ZaloClientWrapper {
     }
   }
 
+  // Search Zalo's sticker catalog. Each sticker carries its pack (category) ID.
+  async searchStickers(keyword: string): Promise<any[]> {
+    if (!this.state.loggedIn || !this.state.api) {
+      throw new Error("Not logged in");
+    }
+
+    try {
+      const ids: number[] = await this.state.api.getStickers(keyword);
+      if (!Array.isArray(ids) || ids.length === 0) return [];
+      const details: any[] = await this.state.api.getStickersDetail(ids);
+      console.log(`[ZaloClient] Found ${details.length} stickers for "${keyword}"`);
+      return details.map(serializeSticker);
+    } catch (error: any) {
+      console.error("[ZaloClient] Search stickers failed:", error);
+      throw error;
+    }
+  }
+
+  // Fetch all stickers of a pack (category)
+  async getStickerPack(packId: string): Promise<any[]> {
+    if (!this.state.loggedIn || !this.state.api) {
+      throw new Error("Not logged in");
+    }
+    if (typeof this.state.api.getStickerCategoryDetail !== "function") {
+      throw new Error("This zca-js version can't fetch sticker packs");
+    }
+
+    try {
+      const stickers: any[] = await this.state.api.getStickerCategoryDetail(Number(packId));
+      if (!Array.isArray(stickers) || stickers.length === 0) return [];
+      // Some versions only return the sticker IDs
+      const details: any[] = typeof stickers[0] === "object"
+        ? stickers
+        : await this.state.api.getStickersDetail(stickers.map(Number));
+      console.log(`[ZaloClient] Fetched ${details.length} stickers of pack ${packId}`);
+      return details.map(serializeSticker);
+    } catch (error: any) {
+      console.error("[ZaloClient] Get sticker pack failed:", error);
+      throw error;
+    }
+  }
+
   async getUserInfo(userId: string): Promise<any> {
     if (!this.state.loggedIn || !this.state.api) {
       throw new Error("Not logged in");
@@ -222,12 +493,25 @@ export class ZaloClientWrapper {
       const resp = await this.state.api.getGroupInfo(groupId);
       // zca-js returns { gridInfoMap: { [groupId]: GroupInfo }, removedsGroup, unchangedsGroup }
       const info = resp.gridInfoMap?.[groupId] ?? null;
+      // currentMems has profiles but may be truncated for large groups, memberIds is complete
+      const profiles = new Map<string, { displayName: string; avatar: string }>(
+        (info?.currentMems || []).map((m: any) => [
+          m.id,
+          { displayName: m.dName || m.zaloName || "", avatar: m.avatar || "" },
+        ])
+      );
+      const memberIds: string[] = info?.memberIds?.length ? info.memberIds : [...profiles.keys()];
       console.log(`[ZaloClient] Fetched group info for ${groupId}`);
       return {
         groupId,
         name: info?.name || "",
         avatar: info?.avt || "",
-        memberIds: info?.memberIds || [],
+        memberIds,
+        members: memberIds.map((id) => ({
+          userId: id,
+          displayName: profiles.get(id)?.displayName || "",
+          avatar: profiles.get(id)?.avatar || "",
+        })),
         adminIds: info?.adminIds || [],
         creatorId: info?.creatorId || "",
       };
@@ -267,6 +551,7 @@ export class ZaloClientWrapper {
         userId: f.userId,
         displayName: f.displayName || f.zaloName || "",
         avatar: f.avatar || "",
+        lastActionTime: f.lastActionTime || 0,
       }));
     } catch (error: any) {
       console.error("[ZaloClient] Get all friends failed:", error);
@@ -291,6 +576,194 @@ export class ZaloClientWrapper {
     }
   }
 
+  // zca-js doesn't return the client message ID it generated for a sent message, so it's taken
+  // from the message's echo, waiting briefly if that hasn't arrived yet
+  private async sentIds(messageId?: string): Promise<{ messageId?: string; cliMsgId?: string }> {
+    if (!messageId) return { messageId };
+    let cliMsgId = this.selfCliMsgIds.get(messageId);
+    if (cliMsgId) {
+      this.selfCliMsgIds.delete(messageId);
+      return { messageId, cliMsgId };
+    }
+    cliMsgId = await new Promise<string | undefined>((resolve) => {
+      const timer = setTimeout(() => {
+        this.selfEchoWaiters.delete(messageId);
+        resolve(undefined);
+      }, SELF_ECHO_TIMEOUT);
+      this.selfEchoWaiters.set(messageId, (id) => {
+        clearTimeout(timer);
+        this.selfEchoWaiters.delete(messageId);
+        resolve(id);
+      });
+    });
+    if (!cliMsgId) console.warn(`[ZaloClient] No echo of sent message ${messageId}, it can't be quoted`);
+    return { messageId, cliMsgId };
+  }
+
+  private recordSelfMessage(message: any): void {
+    const msgId = message.data?.msgId;
+    const cliMsgId = message.data?.cliMsgId;
+    if (!msgId || !cliMsgId) return;
+    const waiter = this.selfEchoWaiters.get(String(msgId));
+    if (waiter) {
+      waiter(String(cliMsgId));
+      return;
+    }
+    // Also catches messages sent from other devices, so keep only the latest ones
+    this.selfCliMsgIds.set(String(msgId), String(cliMsgId));
+    if (this.selfCliMsgIds.size > SELF_ECHO_LIMIT) {
+      this.selfCliMsgIds.delete(this.selfCliMsgIds.keys().next().value!);
+    }
+  }
+
+  // Fetch up to `count` messages of a thread, oldest first.
+  // Without `after` the newest messages before `before` (or now) are returned, with `after` the oldest ones after it.
+  // History only reaches back HISTORY_SCAN_LIMIT messages: the group history API takes no cursor, and DMs are
+  // found by scanning the account's recent messages. hasMore only says whether that window has more messages
+  // past the page, so it's false once the window is used up even if Zalo keeps older messages.
+  async getHistory(
+    threadId: string,
+    threadType: ThreadType,
+    count: number,
+    before?: HistoryCursor,
+    after?: HistoryCursor
+  ): Promise<{ messages: any[]; hasMore: boolean }> {
+    if (!this.state.loggedIn || !this.state.api) {
+      throw new Error("Not logged in");
+    }
+
+    try {
+      const raw = threadType === 1 && typeof this.state.api.getGroupChatHistory === "function"
+        ? await this.fetchGroupHistory(threadId)
+        : await this.scanOldMessages(threadId, threadType, count, before, after);
+
+      const messages = raw
+        .map((message) => ({ ...serializeMessage(message), threadId, threadType }))
+        .filter((msg) => msg.msgId && (!before || isBefore(msg, before)) && (!after || isBefore(after, msg)))
+        .sort(compareMessages);
+
+      const hasMore = messages.length > count;
+      const page = after ? messages.slice(0, count) : messages.slice(-count);
+      console.log(`[ZaloClient] Fetched ${page.length} history messages for ${threadId}`);
+      return { messages: page, hasMore };
+    } catch (error: any) {
+      console.error("[ZaloClient] Get history failed:", error);
+      throw error;
+    }
+  }
+
+  private async fetchGroupHistory(groupId: string): Promise<any[]> {
+    const resp = await this.state.api.getGroupChatHistory(groupId, HISTORY_SCAN_LIMIT);
+    // Returns raw message data, so wrap it like the listener's GroupMessage objects
+    return (resp?.groupMsgs || []).map((data: any) => ({
+      data,
+      threadId: groupId,
+      isSelf: data.uidFrom === "0" || data.uidFrom === this.state.ownId,
+    }));
+  }
+
+  // Scan the account's recent messages for the ones in the requested thread, stopping once
+  // there are enough for the page, plus one to know whether there are more
+  private async scanOldMessages(
+    threadId: string,
+    threadType: ThreadType,
+    count: number,
+    before?: HistoryCursor,
+    after?: HistoryCursor
+  ): Promise<any[]> {
+    const found: any[] = [];
+    let usable = 0;
+    await this.scanRecentMessages(threadType, (batch, oldestTs) => {
+      for (const message of batch) {
+        if (message.threadId !== threadId) continue;
+        found.push(message);
+        if (!before || Number(message.data?.ts) < before.timestamp) usable++;
+      }
+      return after ? oldestTs <= after.timestamp : usable > count;
+    });
+    return found;
+  }
+
+  // The account's recently active threads, newest first, with the time of their latest message.
+  // Only threads with a message among the last HISTORY_SCAN_LIMIT messages of their type are listed.
+  async getConversations(): Promise<{ threadId: string; threadType: ThreadType; lastMessageTime: number }[]> {
+    if (!this.state.loggedIn || !this.state.api) {
+      throw new Error("Not logged in");
+    }
+
+    const latest = new Map<string, { threadId: string; threadType: ThreadType; lastMessageTime: number }>();
+    for (const threadType of [0, 1] as ThreadType[]) {
+      try {
+        await this.scanRecentMessages(threadType, (batch) => {
+          for (const message of batch) {
+            const ts = Number(message.data?.ts);
+            if (!message.threadId || !ts) continue;
+            const key = `${message.threadId}:${threadType}`;
+            if (ts > (latest.get(key)?.lastMessageTime ?? 0)) {
+              latest.set(key, { threadId: String(message.threadId), threadType, lastMessageTime: ts });
+            }
+          }
+          return false;
+        });
+      } catch (error: any) {
+        // Keep the threads of the other type and what was scanned before the error
+        console.error(`[ZaloClient] Scanning recent messages of thread type ${threadType} failed:`, error);
+      }
+    }
+    const conversations = [...latest.values()].sort((a, b) => b.lastMessageTime - a.lastMessageTime);
+    console.log(`[ZaloClient] Found ${conversations.length} recent conversations`);
+    return conversations;
+  }
+
+  // Page backwards through the account's recent messages of a thread type until `done` returns true,
+  // there are no more, or HISTORY_SCAN_LIMIT messages were scanned
+  private async scanRecentMessages(
+    threadType: ThreadType,
+    done: (batch: any[], oldestTs: number) => boolean
+  ): Promise<void> {
+    let lastMsgId: string | undefined;
+    for (let scanned = 0; scanned < HISTORY_SCAN_LIMIT;) {
+      const batch = await this.requestOldMessages(threadType, lastMsgId);
+      if (batch.length === 0) break;
+      scanned += batch.length;
+
+      let oldest = batch[0];
+      for (const message of batch) {
+        if (Number(message.data?.ts) < Number(oldest.data?.ts)) oldest = message;
+      }
+      if (done(batch, Number(oldest.data?.ts))) break;
+      if (oldest.data?.msgId === lastMsgId) break;
+      lastMsgId = oldest.data?.msgId;
+    }
+  }
+
+  // The listener answers every old messages request with the same event, which doesn't say
+  // which request it answers, so requests of a session are sent one at a time
+  private requestOldMessages(threadType: ThreadType, lastMsgId?: string): Promise<any[]> {
+    const result = this.oldMessagesQueue.then(() => this.sendOldMessagesRequest(threadType, lastMsgId));
+    this.oldMessagesQueue = result.catch(() => undefined);
+    return result;
+  }
+
+  private sendOldMessagesRequest(threadType: ThreadType, lastMsgId?: string): Promise<any[]> {
+    const listener = this.state.api.listener;
+    return new Promise((resolve, reject) => {
+      const onOldMessages = (messages: any[], type: ThreadType) => {
+        if (type !== threadType) return;
+        clearTimeout(timer);
+        listener.off("old_messages", onOldMessages);
+        resolve(messages || []);
+      };
+      const timer = setTimeout(() => {
+        listener.off("old_messages", onOldMessages);
+        reject(new Error("Timed out waiting for old messages"));
+      }, OLD_MESSAGES_TIMEOUT);
+
+      listener.on("old_messages", onOldMessages);
+      listener.requestOldMessages(threadType, lastMsgId);
+    });
+  }
+
   setupListeners(broadcast: BroadcastFn): void {
     if (!this.state.api) {
       console.warn("[ZaloClient] Cannot setup listeners - no API instance");
@@ -301,6 +774,7 @@ export class ZaloClientWrapper {
     console.log("[ZaloClient] Setting up event listeners...");
 
     listener.on("message", (message: any) => {
+      if (message.isSelf) this.recordSelfMessage(message);
       handleMessage(message, broadcast);
     });
 
@@ -340,6 +814,7 @@ export class ZaloClientWrapper {
       this.state.api.listener.stop();
     }
     this.zalo = null;
+    this.pendingQRLogin = null;
 
     this.state = {
       api: null,